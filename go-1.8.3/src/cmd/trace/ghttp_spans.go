@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"internal/trace"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// lbh trace net/http 写进 execution trace 的 span (runtime.TraceSpanStart),
+// /spans 列出所有 span, /spans?trace=<traceId> 只看一个 trace
+func init() {
+	http.HandleFunc("/spans", httpSpans)
+}
+
+//
+type spanDesc struct {
+	Kind     string
+	TraceId  string
+	SpanId   string
+	G        uint64 // span 开始的协程
+	Start    time.Duration
+	Duration time.Duration // 没有结束事件的算到 trace 结束
+	Finished bool
+}
+
+//
+func httpSpans(w http.ResponseWriter, r *http.Request) {
+	events, err := parseEvents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	spans := spanDescs(events, r.FormValue("trace"))
+	sort.Sort(spansByStart(spans))
+	if err := templSpans.Execute(w, spans); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// traceId 为空的返回所有 span
+func spanDescs(events []*trace.Event, traceId string) []*spanDesc {
+	var lastTs int64
+	if len(events) > 0 {
+		lastTs = events[len(events)-1].Ts
+	}
+	var spans []*spanDesc
+	for _, ev := range events {
+		kind := spanKind(ev.Type)
+		if kind == "" {
+			continue
+		}
+		s := &spanDesc{
+			Kind:     kind,
+			TraceId:  formatTraceId(ev.Args[0], ev.Args[1]),
+			SpanId:   fmt.Sprintf("%016x", ev.Args[2]),
+			G:        ev.G,
+			Start:    time.Duration(ev.Ts),
+			Duration: time.Duration(lastTs - ev.Ts),
+		}
+		if traceId != "" && s.TraceId != traceId {
+			continue
+		}
+		if ev.Link != nil {
+			s.Duration = time.Duration(ev.Link.Ts - ev.Ts)
+			s.Finished = true
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+// 不是 span 开始的事件返回 ""
+func spanKind(typ byte) string {
+	switch typ {
+	case trace.EvSpanServer:
+		return "server"
+	case trace.EvSpanClient:
+		return "client"
+	case trace.EvSpanLocal:
+		return "local"
+	}
+	return ""
+}
+
+// 和 net/http 里的一样, 64 位的 high 为 0
+func formatTraceId(high, low uint64) string {
+	if high == 0 {
+		return fmt.Sprintf("%016x", low)
+	}
+	return fmt.Sprintf("%016x%016x", high, low)
+}
+
+type spansByStart []*spanDesc
+
+func (l spansByStart) Len() int           { return len(l) }
+func (l spansByStart) Less(i, j int) bool { return l[i].Start < l[j].Start }
+func (l spansByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+var templSpans = template.Must(template.New("").Parse(`
+<html>
+<body>
+<table border="1" sortable="1">
+<tr>
+<th>Kind</th>
+<th>Trace</th>
+<th>Span</th>
+<th>Goroutine</th>
+<th>Start</th>
+<th>Duration</th>
+</tr>
+{{range $}}
+  <tr>
+    <td>{{.Kind}}</td>
+    <td><a href="/spans?trace={{.TraceId}}">{{.TraceId}}</a></td>
+    <td>{{.SpanId}}</td>
+    <td><a href="/trace?goid={{.G}}">{{.G}}</a></td>
+    <td>{{.Start}}</td>
+    <td>{{.Duration}}{{if not .Finished}} (unfinished){{end}}</td>
+  </tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"internal/trace"
+	"testing"
+	"time"
+)
+
+func TestSpanDescs(t *testing.T) {
+	end := &trace.Event{Type: trace.EvSpanEnd, Ts: 30, Args: [3]uint64{0x1111}}
+	events := []*trace.Event{
+		{Type: trace.EvSpanServer, Ts: 10, G: 7, Args: [3]uint64{0, 0xabc, 0x1111}, Link: end},
+		{Type: trace.EvGoBlock, Ts: 15, G: 7},
+		{Type: trace.EvSpanClient, Ts: 20, G: 8, Args: [3]uint64{0x1, 0x2, 0x2222}},
+		end,
+		{Type: trace.EvGoEnd, Ts: 50, G: 8},
+	}
+
+	spans := spanDescs(events, "")
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans; want 2", len(spans))
+	}
+	want := []spanDesc{
+		{"server", "0000000000000abc", "0000000000001111", 7, 10, 20, true},
+		{"client", "00000000000000010000000000000002", "0000000000002222", 8, 20, 30, false},
+	}
+	for i, s := range spans {
+		if *s != want[i] {
+			t.Errorf("span %d = %+v; want %+v", i, *s, want[i])
+		}
+	}
+
+	spans = spanDescs(events, "0000000000000abc")
+	if len(spans) != 1 || spans[0].SpanId != "0000000000001111" || spans[0].Duration != 20*time.Nanosecond {
+		t.Errorf("trace filter: got %+v", spans)
+	}
+}
@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 和 runtime 一样编码事件, 3 个以上参数的先写长度
+func emitEvent(buf *bytes.Buffer, typ byte, args ...uint64) {
+	narg := byte(len(args)) - 1
+	if narg > 3 {
+		narg = 3
+	}
+	ev := []byte{typ | narg<<6}
+	if narg == 3 {
+		ev = append(ev, 0)
+	}
+	for _, a := range args {
+		for ; a >= 0x80; a >>= 7 {
+			ev = append(ev, 0x80|byte(a))
+		}
+		ev = append(ev, byte(a))
+	}
+	if narg == 3 {
+		ev[1] = byte(len(ev) - 2)
+	}
+	buf.Write(ev)
+}
+
+func TestParseSpans(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("go 1.8 trace\x00\x00\x00\x00")
+	emitEvent(&buf, EvBatch, 0, 0)
+	emitEvent(&buf, EvFrequency, 1e9)
+	emitEvent(&buf, EvSpanServer, 1, 0, 0x48485a3953bb6124, 0x1111)
+	emitEvent(&buf, EvSpanLocal, 1, 0x463ac35c9f6413ad, 0x48485a3953bb6124, 0x2222)
+	emitEvent(&buf, EvSpanEnd, 1, 0x2222)
+	emitEvent(&buf, EvSpanEnd, 1, 0x1111)
+	// 没有开始的结束 (trace 开始前的 span) 和没有结束的开始都不是错
+	emitEvent(&buf, EvSpanEnd, 1, 0x3333)
+	emitEvent(&buf, EvSpanClient, 1, 0, 0x48485a3953bb6124, 0x4444)
+
+	events, err := Parse(&buf, "")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	starts := map[uint64]*Event{}
+	for _, ev := range events {
+		switch ev.Type {
+		case EvSpanServer, EvSpanClient, EvSpanLocal:
+			starts[ev.Args[2]] = ev
+		}
+	}
+	tests := []struct {
+		span      uint64
+		typ       byte
+		high, low uint64
+		dur       int64 // -1 没有结束
+	}{
+		{0x1111, EvSpanServer, 0, 0x48485a3953bb6124, 3},
+		{0x2222, EvSpanLocal, 0x463ac35c9f6413ad, 0x48485a3953bb6124, 1},
+		{0x4444, EvSpanClient, 0, 0x48485a3953bb6124, -1},
+	}
+	for _, tt := range tests {
+		ev := starts[tt.span]
+		if ev == nil {
+			t.Errorf("span %#x: no start event", tt.span)
+			continue
+		}
+		if ev.Type != tt.typ || ev.Args[0] != tt.high || ev.Args[1] != tt.low {
+			t.Errorf("span %#x: type %v trace %#x %#x; want %v %#x %#x",
+				tt.span, ev.Type, ev.Args[0], ev.Args[1], tt.typ, tt.high, tt.low)
+		}
+		if tt.dur < 0 {
+			if ev.Link != nil {
+				t.Errorf("span %#x: linked to %v at %v, want no end", tt.span, EventDescriptions[ev.Link.Type].Name, ev.Link.Ts)
+			}
+			continue
+		}
+		if ev.Link == nil || ev.Link.Type != EvSpanEnd {
+			t.Errorf("span %#x: not linked to its end", tt.span)
+			continue
+		}
+		if d := ev.Link.Ts - ev.Ts; d != tt.dur {
+			t.Errorf("span %#x: duration %v; want %v", tt.span, d, tt.dur)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package log
+
+import (
+	"sync/atomic"
+)
+
+//
+var lineHook atomic.Value // func(s string) string
+
+// SetLineHook 设置每条 log 写出去之前调用的 hook, 在调用 Print 的协程上执行,
+// s 是消息, 返回值加在日期, 文件名这些 header 后面, 消息前面. 所有 Logger 都生效, nil 取消.
+// net/http.SetLogTrace 用它给 log 加上 "trace=<id> span=<id> "
+func SetLineHook(hook func(s string) string) {
+	lineHook.Store(hook)
+}
+
+//
+func getLineHook() func(s string) string {
+	hook, _ := lineHook.Load().(func(s string) string)
+	return hook
+}
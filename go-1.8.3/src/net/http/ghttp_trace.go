@@ -1,19 +1,34 @@
 package http
 
 import (
-	"fmt"
+	"context"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //
 type spanSlot struct {
-	spans []*traceSpan
+	spans []spanEntry
 	sync.Mutex
 }
 
+// 协程 gid 当前所在的 span, 同一个 span 可以放在多个协程下.
+// 没采样的请求只在 TraceToken 的 Run, Bind 时放进来, 只有 unsampled
+type spanEntry struct {
+	gid       int64
+	span      *traceSpan
+	unsampled *unsampledTrace
+	nano      int64 // 放进来的时间
+}
+
+// span 和 unsampled 都没有
+func (e spanEntry) empty() bool {
+	return e.span == nil && e.unsampled == nil
+}
+
 const (
 	spanCellSize      = 1024
 	spanExpireTimeSec = 240 // 4 min
@@ -27,45 +42,84 @@ var (
 	scanSpanIdx      = 0
 	lastScanSpanTime = int64(0)
 	enableHttpTrace  = true
+
+	// server span 放在 req.Context() 里的 key
+	traceSpanContextKey = &contextKey{"trace-span"}
+
+	// spanTable 里的记录个数, 为 0 时不用找协程链
+	spanEntries int64
 )
 
 func SetHttpTrace(enable bool) {
 	enableHttpTrace = enable
 }
 
-//
-func (t *SpanTable) addSpan(gid int64, span *traceSpan) {
+// 返回 gid 原来的记录
+func (t *SpanTable) addSpan(gid int64, span *traceSpan) (prev spanEntry) {
+	return t.setEntry(gid, spanEntry{span: span})
+}
+
+// 返回 gid 原来的记录, e 是空的时候删掉 gid
+func (t *SpanTable) setEntry(gid int64, e spanEntry) (prev spanEntry) {
+	if e.empty() {
+		return t.delSpan(gid)
+	}
 	idx := gid % spanCellSize
+	e.gid = gid
+	e.nano = time.Now().UnixNano()
 	t[idx].Lock()
 	if t[idx].spans == nil {
-		t[idx].spans = []*traceSpan{}
+		t[idx].spans = []spanEntry{}
 	}
 
-	for i, s := range t[idx].spans {
-		if s.gid == gid {
-			t[idx].spans[i] = span
+	for i := range t[idx].spans {
+		if t[idx].spans[i].gid == gid {
+			prev = t[idx].spans[i]
+			t[idx].spans[i] = e
 			t[idx].Unlock()
 			return
 		}
 	}
-	span.gid = gid
-	t[idx].spans = append(t[idx].spans, span)
+	t[idx].spans = append(t[idx].spans, e)
+	atomic.AddInt64(&spanEntries, 1)
 	t[idx].Unlock()
 
 	t.exprieSpan()
+	return
 }
 
 // span
-func (t *SpanTable) getSpan(gid int64) (ret *traceSpan) {
-	ret = nil
+func (t *SpanTable) getSpan(gid int64) *traceSpan {
+	return t.getEntry(gid).span
+}
+
+//
+func (t *SpanTable) getEntry(gid int64) (ret spanEntry) {
 	idx := gid % spanCellSize
 	t[idx].Lock()
-	if t[idx].spans != nil {
-		for _, span := range t[idx].spans {
-			if span.gid == gid {
-				ret = span
-				break
-			}
+	for _, e := range t[idx].spans {
+		if e.gid == gid {
+			ret = e
+			break
+		}
+	}
+	t[idx].Unlock()
+	return
+}
+
+// 返回 gid 原来的记录
+func (t *SpanTable) delSpan(gid int64) (prev spanEntry) {
+	if atomic.LoadInt64(&spanEntries) == 0 {
+		return
+	}
+	idx := gid % spanCellSize
+	t[idx].Lock()
+	for i, e := range t[idx].spans {
+		if e.gid == gid {
+			prev = e
+			t[idx].spans = append(t[idx].spans[:i], t[idx].spans[i+1:]...)
+			atomic.AddInt64(&spanEntries, -1)
+			break
 		}
 	}
 	t[idx].Unlock()
@@ -82,15 +136,16 @@ func (t *SpanTable) exprieSpan() {
 	idx := scanSpanIdx % spanCellSize
 	scanSpanIdx++
 
-	spanTable[idx].Lock()
-	defer spanTable[idx].Unlock()
-	if spanTable[idx].spans == nil {
+	t[idx].Lock()
+	defer t[idx].Unlock()
+	if t[idx].spans == nil {
 		return
 	}
 
-	for i := 0; i < len(spanTable[idx].spans); i++ {
-		if now-spanTable[idx].spans[i].Timestamp > 1e9*240 {
-			spanTable[idx].spans = append(spanTable[idx].spans[:i], spanTable[idx].spans[:i+1]...)
+	for i := 0; i < len(t[idx].spans); i++ {
+		if now-t[idx].spans[i].nano > 1e9*spanExpireTimeSec {
+			t[idx].spans = append(t[idx].spans[:i], t[idx].spans[i+1:]...)
+			atomic.AddInt64(&spanEntries, -1)
 			i--
 		}
 	}
@@ -98,30 +153,101 @@ func (t *SpanTable) exprieSpan() {
 
 // 从协程链里找到接受req的协程
 func getSpanByPG() *traceSpan {
-	gid := runtime.Getgid()
+	return getSpanByGid(runtime.Getgid())
+}
 
-	pgids := make([]int64, 100)
-	n := runtime.Getgpid(gid, pgids)
+// 从 gid 的协程链里找到接受req的协程, 在没采样的请求里返回 nil
+func getSpanByGid(gid int64) *traceSpan {
+	if atomic.LoadInt64(&spanEntries) == 0 {
+		return nil
+	}
+	var pgids [100]int64
+	n := runtime.Getgpid(gid, pgids[:])
 	for i := 0; i < n; i++ {
-		pid := pgids[i]
-		// if span := spansMap.GetSpan(pid); span != nil {
-		if span := spanTable.getSpan(pid); span != nil {
-			if span.isRecvReq {
-				return span
+		e := spanTable.getEntry(pgids[i])
+		if e.unsampled != nil {
+			return nil
+		}
+		if e.span != nil {
+			if recv := e.span.recvSpan(); recv != nil {
+				return recv
 			}
 		}
 	}
 	return nil
 }
 
+// 从协程链里找到最近的 span, 可能是 server span, 也可能是 StartSpan 开始的 span,
+// 在没采样的请求里返回 nil
+func getCurSpan() *traceSpan {
+	return getCurTrace().span
+}
+
+// 协程链上最近的记录, span 或者没采样的请求
+func getCurTrace() spanEntry {
+	return getTraceByGid(runtime.Getgid())
+}
+
+//
+func getTraceByGid(gid int64) spanEntry {
+	if atomic.LoadInt64(&spanEntries) == 0 {
+		return spanEntry{}
+	}
+	var pgids [100]int64
+	n := runtime.Getgpid(gid, pgids[:])
+	for i := 0; i < n; i++ {
+		if e := spanTable.getEntry(pgids[i]); !e.empty() {
+			return e
+		}
+	}
+	return spanEntry{}
+}
+
+// ctx 里的 span 或者没采样的请求, 只查一次 ctx
+func getTraceFromContext(ctx context.Context) spanEntry {
+	if ctx == nil {
+		return spanEntry{}
+	}
+	switch v := ctx.Value(traceSpanContextKey).(type) {
+	case *traceSpan:
+		return spanEntry{span: v}
+	case *unsampledTrace:
+		return spanEntry{unsampled: v}
+	}
+	return spanEntry{}
+}
+
+// 从 ctx 里找 span, 没有返回 nil
+func getSpanFromContext(ctx context.Context) *traceSpan {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(traceSpanContextKey).(*traceSpan)
+	return span
+}
+
 // 接受请求
 // 从 recv 的 req 里解析span，记录下来,  SR
 func onHttpProcRecvReq(resp *response) *traceSpan {
 	if !enableHttpTrace {
 		return nil
 	}
+	// 先在栈上解析 header 决定采不采样, 没采样的不分配 span
+	th := parseTraceHeader(resp.req.Header)
+	if !th.decided {
+		th.sampled = sampleRoot(resp.req)
+	}
+	if !th.sampled {
+		// 只放在 ctx 里, 一次分配, 不进 spanTable
+		resp.req.ctx = &unsampledTrace{Context: resp.req.Context(), traceId: th.traceId, spanId: th.spanId, flags: th.flags}
+		if leakDetectorEnabled() {
+			runtime.ResetgPeak(runtime.Getgid())
+		}
+		return nil
+	}
+
 	span := newTraceSpan()
-	span.fromHeader(resp.req.Header)
+	span.fromTraceHeader(th)
 	span.Name = resp.req.Method
 
 	// sr
@@ -131,21 +257,33 @@ func onHttpProcRecvReq(resp *response) *traceSpan {
 	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: port}
 	span.addAnnotation(ep, getTraceTime(), "sr")
 	span.isRecvReq = true
+	if span.isRoot {
+		span.addBinAnnotation(ep, "trace.root", "true")
+	}
 
 	// url, method
-	span.addBinAnnotation(ep, "http.url", "http://"+resp.req.Host+resp.req.URL.String())
+	span.addBinAnnotation(ep, "http.url", "http://"+resp.req.Host+redactUrl(resp.req.URL))
 	span.addBinAnnotation(ep, "http.method", resp.req.Method)
+	addReqHeaderAnnotations(span, ep, resp.req.Header)
+	wrapServerReqBody(resp)
 
 	// add ca
 	epRemote := &endpoint{ServiceName: execName}
 	epRemote.Ipv4, epRemote.Port = getAddrFromString(resp.req.RemoteAddr)
-	fmt.Println("remote addr  ", resp.req.RemoteAddr)
-	fmt.Printf("epRemote : %##v\n", epRemote)
 	span.addBinAnnotation(epRemote, "ca", "true")
 
 	// add to map
 	gid := runtime.Getgid()
+	span.gid = gid
 	spanTable.addSpan(gid, span)
+	traceExecSpanStart(runtime.TraceSpanServer, span)
+	runtime.ResetgPeak(gid)
+	if span.isDebug() {
+		runtime.StartgBlockTrace(gid)
+	}
+
+	// 也放到 req.Context() 里, 请求前就建好的协程拿到 ctx 也能找到 span
+	resp.req.ctx = context.WithValue(resp.req.Context(), traceSpanContextKey, span)
 	return span
 }
 
@@ -155,19 +293,40 @@ func onHttpSendResp(resp *response, span *traceSpan) {
 	if !enableHttpTrace {
 		return
 	}
-	if span != nil {
-		ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
-		span.addAnnotation(ep, getTraceTime(), "ss")
-		span.Duration = getTraceTime() - span.Timestamp
-
-		logTrace(span)
-	} else {
-		span := newTraceSpan()
-		span.fromHeader(resp.req.Header)
-		// span.Path = resp.req.RequestURI
-		span.Name = resp.req.Method
-		panic("not here")
+	// 请求结束了, 连接协程处理下一个请求之前不再属于这个请求, 也清掉 handler 里 Bind 的
+	gid := runtime.Getgid()
+	spanTable.delSpan(gid)
+	if span == nil { // 没采样, 泄漏检测照样做
+		if leakDetectorEnabled() {
+			addFinishedUnsampled(resp.req, gid)
+		}
+		return
+	}
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
+	span.addAnnotation(ep, getTraceTime(), "ss")
+	span.Duration = getTraceTime() - span.Timestamp
+	traceExecSpanEnd(span)
+
+	addRespHeaderAnnotations(span, ep, resp.handlerHeader)
+	addServerRespAnnotations(resp, span, ep)
+	addPeakDescendants(span, ep)
+	var blocks map[int64]goroutineBlocks
+	if span.isDebug() {
+		blocks = stopRequestBlocks(span.gid)
+		addBlockAnnotations(span, ep, blocks[span.gid], newGpClock())
 	}
+	var goroutines []runtime.GpInfo
+	logGoroutines := enableGoroutineSpan || span.isDebug()
+	if logGoroutines || leakDetectorEnabled() {
+		goroutines = getRequestGoroutines(span.gid)
+	}
+	if logGoroutines {
+		logGoroutineSpans(span, goroutines, blocks)
+	}
+	if leakDetectorEnabled() {
+		addFinishedSpan(span, goroutines)
+	}
+	logTrace(span)
 }
 
 //
@@ -175,9 +334,17 @@ func onHttpServerErr(resp *response, span *traceSpan, err error) {
 	if !enableHttpTrace {
 		return
 	}
+	spanTable.delSpan(runtime.Getgid())
+	if span == nil {
+		return
+	}
+	if span.isDebug() {
+		stopRequestBlocks(span.gid)
+	}
 	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
 	span.addBinAnnotation(ep, "error", err.Error())
 	span.Duration = getTraceTime() - span.Timestamp
+	traceExecSpanEnd(span)
 
 	span.addAnnotation(ep, getTraceTime(), "ss")
 
@@ -193,7 +360,33 @@ func onHttpSendReq(req *Request) *traceSpan {
 	if !enableHttpTrace {
 		return nil
 	}
-	parentSpan := getSpanByPG()
+	if req.Header == nil {
+		req.Header = make(Header)
+	}
+	// 先看 req.Context(), 没有再找协程链
+	cur := getTraceFromContext(req.Context())
+	if cur.empty() {
+		cur = getCurTrace()
+	}
+	parentSpan, u := cur.span, cur.unsampled
+	if u != nil {
+		u.setHeader(req.Header)
+		return nil
+	}
+
+	// 没采样的只传 header, 不分配 span
+	if parentSpan != nil && !parentSpan.isSample {
+		setUnsampledHeader(req.Header, parentSpan.TraceId, parentSpan.SpanId, parentSpan.flags)
+		return nil
+	}
+	sampled := true
+	if parentSpan == nil {
+		if sampled = sampleRoot(req); !sampled {
+			setUnsampledHeader(req.Header, genTraceId(), "", "")
+			return nil
+		}
+	}
+
 	span := newTraceSpan()
 	span.SpanId = genSpanId()
 	// span.Path = req.URL.String()
@@ -208,38 +401,55 @@ func onHttpSendReq(req *Request) *traceSpan {
 		ep.Port = parentSpan.localPort
 		span.localPort = parentSpan.localPort
 	} else { // 找到
-		span.TraceId = genSpanId()
+		span.TraceId = genTraceId()
+		span.isRoot = true
+		span.isSample = sampled
 		span.localPort = 80
+		span.addBinAnnotation(ep, "trace.root", "true")
 	}
 	span.addAnnotation(ep, getTraceTime(), "cs")
+	traceExecSpanStart(runtime.TraceSpanClient, span)
+	addReqHeaderAnnotations(span, ep, req.Header)
 	span.setHeader(req.Header)
-	span.addBinAnnotation(ep, "http.url", req.URL.String())
+	span.addBinAnnotation(ep, "http.url", redactUrl(req.URL))
 	span.addBinAnnotation(ep, "http.method", req.Method)
+	if req.ContentLength >= 0 {
+		span.addBinAnnotation(ep, "http.request.size", strconv.FormatInt(req.ContentLength, 10))
+	}
 
 	return span
 }
 
 // 接收到 respone, CR
 func onHttpRecvResp(resp *Response, span *traceSpan) {
-	if !enableHttpTrace {
+	if !enableHttpTrace || span == nil {
 		return
 	}
 	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
 	span.addAnnotation(ep, getTraceTime(), "cr")
 	span.addBinAnnotation(ep, "http.status_code", strconv.Itoa(resp.StatusCode))
+	if resp.ContentLength >= 0 {
+		span.addBinAnnotation(ep, "http.response.size", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	addRespHeaderAnnotations(span, ep, resp.Header)
 	span.Duration = getTraceTime() - span.Timestamp
+	traceExecSpanEnd(span)
 
+	if wrapClientRespBody(resp, span, ep) {
+		return
+	}
 	logTrace(span)
 }
 
 //
 func onHttpClientErr(req *Request, span *traceSpan, err error) {
-	if !enableHttpTrace {
+	if !enableHttpTrace || span == nil {
 		return
 	}
 	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: 80}
 	span.addBinAnnotation(ep, "error", err.Error())
 	span.Duration = getTraceTime() - span.Timestamp
+	traceExecSpanEnd(span)
 
 	span.addAnnotation(ep, getTraceTime(), "cr")
 
@@ -0,0 +1,292 @@
+package http
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+)
+
+// TraceToken 保存当前的 span, 交给协程链不相关的协程 (任务队列, 连接池),
+// 让它们发出的请求挂在这个 span 下, 而不是各自新建一个 trace
+type TraceToken struct {
+	e spanEntry // span, 或者没采样的请求
+}
+
+// CaptureTraceToken 取当前协程所在的 span, 找不到返回 nil
+func CaptureTraceToken() *TraceToken {
+	return newTraceToken(getCurTrace())
+}
+
+// CaptureTraceTokenContext 先从 ctx 里找 span, 没有再找协程链
+func CaptureTraceTokenContext(ctx context.Context) *TraceToken {
+	if span := getSpanFromContext(ctx); span != nil {
+		return newTraceToken(spanEntry{span: span})
+	}
+	if u := getUnsampledFromContext(ctx); u != nil {
+		return newTraceToken(spanEntry{unsampled: u})
+	}
+	return CaptureTraceToken()
+}
+
+//
+func newTraceToken(e spanEntry) *TraceToken {
+	if e.empty() {
+		return nil
+	}
+	return &TraceToken{e: spanEntry{span: e.span, unsampled: e.unsampled}}
+}
+
+// Run 在当前协程上以 t 的 span 执行 fun, 返回后恢复当前协程原来的 span. t 为 nil 时直接执行 fun.
+// fun 里创建的协程按协程链找 span, 只在 Run 返回前算在 t 的 span 下, 比 Run 活得久的协程
+// 之后找到的是当前协程原来的 span; 这种协程要在自己里面调 t.Bind, 或者把 t 放进 ctx 传过去
+func (t *TraceToken) Run(fun func()) {
+	if t == nil || !enableHttpTrace {
+		fun()
+		return
+	}
+	gid := runtime.Getgid()
+	prev := spanTable.setEntry(gid, t.e)
+	defer spanTable.setEntry(gid, prev)
+	fun()
+}
+
+// Bind 把当前协程标记为在 t 的 span 下工作, 直到 UnbindTraceToken 或下一次 Bind,
+// 适合一个协程只为一个请求干活的情况, 其它情况用 Run
+func (t *TraceToken) Bind() {
+	if t == nil || !enableHttpTrace {
+		return
+	}
+	spanTable.setEntry(runtime.Getgid(), t.e)
+}
+
+// UnbindTraceToken 取消 Bind
+func UnbindTraceToken() {
+	spanTable.delSpan(runtime.Getgid())
+}
+
+// ------------------------------------------------------------------------------------
+// 自定义 span
+
+// Span 用户自己记录的 span, 比如查缓存这种本地调用, 或者非 http 协议的远程调用.
+// 方法在 nil 上调用什么都不做, 关掉 trace 时 StartSpan 返回 nil
+type Span struct {
+	span      *traceSpan
+	unsampled *unsampledTrace // 没采样的请求里的远程调用, 只用来 Propagate
+	ep        *endpoint
+	gid       int64     // 开始 span 的协程
+	prev      spanEntry // gid 原来的 span, Finish 时恢复
+	remote    bool
+	finished  int32 // atomic, 只 Finish 一次
+}
+
+// StartSpan 在当前协程的 span 下开始一个本地 span, 没有就新开一个 trace.
+// Finish 之前, 当前协程和它创建的协程发出的 http 请求都挂在这个 span 下.
+// 在没采样的请求里返回 nil; 没采样的请求只在 req.Context() 里, 协程链上找不到,
+// handler 里要用 StartSpanContext, 或者在 CaptureTraceTokenContext 的 Run 里调
+func StartSpan(name string) *Span {
+	cur := getCurTrace()
+	if cur.unsampled != nil {
+		return nil
+	}
+	return startSpan(cur.span, name, false)
+}
+
+// StartSpanContext 和 StartSpan 一样, 先从 ctx 里找父 span, 返回的 ctx 里带着新的 span.
+// ctx 属于没采样的请求时返回 nil 和原来的 ctx
+func StartSpanContext(ctx context.Context, name string) (*Span, context.Context) {
+	if getUnsampledFromContext(ctx) != nil {
+		return nil, ctx
+	}
+	parent := getSpanFromContext(ctx)
+	if parent == nil {
+		cur := getCurTrace()
+		if cur.unsampled != nil {
+			return nil, ctx
+		}
+		parent = cur.span
+	}
+	s := startSpan(parent, name, false)
+	if s != nil {
+		ctx = context.WithValue(ctx, traceSpanContextKey, s.span)
+	}
+	return s, ctx
+}
+
+// StartRemoteSpan 开始一个远程调用的 span, 记录 cs/cr 和对方地址 sa,
+// 用 Propagate 把 trace 信息带给对方. 在没采样的请求里不记录, 只能 Propagate,
+// 和 StartSpan 一样, 没采样的请求要在 CaptureTraceTokenContext 的 Run 里调才找得到
+func StartRemoteSpan(name, remoteService, remoteAddr string) *Span {
+	cur := getCurTrace()
+	if cur.unsampled != nil {
+		if !enableHttpTrace {
+			return nil
+		}
+		return &Span{unsampled: cur.unsampled}
+	}
+	s := startSpan(cur.span, name, true)
+	if s != nil {
+		epRemote := &endpoint{ServiceName: remoteService}
+		epRemote.Ipv4, epRemote.Port = getAddrFromString(remoteAddr)
+		s.span.addBinAnnotation(epRemote, "sa", "true")
+	}
+	return s
+}
+
+//
+func startSpan(parent *traceSpan, name string, remote bool) *Span {
+	if !enableHttpTrace {
+		return nil
+	}
+	span := newTraceSpan()
+	span.SpanId = genSpanId()
+	span.Name = name
+
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: 80}
+	if parent != nil {
+		span.fromParentSpan(parent)
+		parent.addChildSpan(span)
+		ep.Port = parent.localPort
+		span.localPort = parent.localPort
+	} else {
+		span.TraceId = genTraceId()
+		span.isSample = sampleRoot(nil)
+		span.isRoot = true
+		span.localPort = 80
+		span.addBinAnnotation(ep, "trace.root", "true")
+	}
+
+	if remote {
+		span.addAnnotation(ep, span.Timestamp, "cs")
+	} else {
+		span.addBinAnnotation(ep, "lc", execName)
+	}
+
+	kind := runtime.TraceSpanLocal
+	if remote {
+		kind = runtime.TraceSpanClient
+	}
+	traceExecSpanStart(kind, span)
+
+	gid := runtime.Getgid()
+	return &Span{
+		span:   span,
+		ep:     ep,
+		gid:    gid,
+		prev:   spanTable.addSpan(gid, span),
+		remote: remote,
+	}
+}
+
+// SetName 设置 span 的名字, Finish 之后不再改
+func (s *Span) SetName(name string) {
+	if s == nil || s.span == nil {
+		return
+	}
+	s.span.setName(name)
+}
+
+// Annotate 记录一个带时间的事件
+func (s *Span) Annotate(value string) {
+	if s == nil || s.span == nil {
+		return
+	}
+	s.span.addAnnotation(s.ep, getTraceTime(), value)
+}
+
+// SetTag 记录一个 key/value
+func (s *Span) SetTag(key, value string) {
+	if s == nil || s.span == nil {
+		return
+	}
+	s.span.addBinAnnotation(s.ep, key, value)
+}
+
+// SetError 记录 error, err 为 nil 不记录
+func (s *Span) SetError(err error) {
+	if s == nil || s.span == nil || err == nil {
+		return
+	}
+	s.span.addBinAnnotation(s.ep, "error", err.Error())
+}
+
+// Propagate 把 trace 信息 (X-W-TraceId 等) 用 set 写到非 http 协议的请求里
+func (s *Span) Propagate(set func(key, value string)) {
+	if s == nil {
+		return
+	}
+	if s.unsampled != nil {
+		s.unsampled.rangeHeader(set)
+		return
+	}
+	s.span.rangeHeader(set)
+}
+
+// Finish 结束 span 并记录, 当前协程恢复到原来的 span. 多次调用只记录一次
+func (s *Span) Finish() {
+	if s == nil || s.span == nil || !atomic.CompareAndSwapInt32(&s.finished, 0, 1) {
+		return
+	}
+	if s.remote {
+		s.span.addAnnotation(s.ep, getTraceTime(), "cr")
+	}
+	s.span.Duration = getTraceTime() - s.span.Timestamp
+	traceExecSpanEnd(s.span)
+
+	if spanTable.getSpan(s.gid) == s.span {
+		spanTable.setEntry(s.gid, s.prev)
+	}
+	logTrace(s.span)
+}
+
+// ------------------------------------------------------------------------------------
+// 给当前请求的 server span 加 annotation
+
+// AddRequestTag 给当前协程所在请求的 server span 加一个 key/value, 比如 cache.hit=true,
+// 不在请求里, 或者 server span 已经记录了, 返回 false
+func AddRequestTag(key, value string) bool {
+	return addRequestTag(getSpanByPG(), key, value)
+}
+
+// AddRequestTagContext 和 AddRequestTag 一样, 先从 ctx 里找 span
+func AddRequestTagContext(ctx context.Context, key, value string) bool {
+	return addRequestTag(getRecvSpanContext(ctx), key, value)
+}
+
+// AddRequestEvent 给当前协程所在请求的 server span 加一个带时间的事件, 比如 "retrying",
+// 返回值和 AddRequestTag 一样
+func AddRequestEvent(value string) bool {
+	return addRequestEvent(getSpanByPG(), value)
+}
+
+// AddRequestEventContext 和 AddRequestEvent 一样, 先从 ctx 里找 span
+func AddRequestEventContext(ctx context.Context, value string) bool {
+	return addRequestEvent(getRecvSpanContext(ctx), value)
+}
+
+// ctx 里的 span 所在请求的 server span, 没有再找协程链
+func getRecvSpanContext(ctx context.Context) *traceSpan {
+	if span := getSpanFromContext(ctx); span != nil {
+		if recv := span.recvSpan(); recv != nil {
+			return recv
+		}
+	}
+	return getSpanByPG()
+}
+
+//
+func addRequestTag(span *traceSpan, key, value string) bool {
+	if span == nil || !enableHttpTrace {
+		return false
+	}
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
+	return span.addBinAnnotation(ep, key, value)
+}
+
+//
+func addRequestEvent(span *traceSpan, value string) bool {
+	if span == nil || !enableHttpTrace {
+		return false
+	}
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
+	return span.addAnnotation(ep, getTraceTime(), value)
+}
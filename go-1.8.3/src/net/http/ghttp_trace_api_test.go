@@ -0,0 +1,332 @@
+package http
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 当前协程在 spanTable 里的记录, 测试结束时恢复
+func saveCurEntry() (restore func()) {
+	gid := runtime.Getgid()
+	prev := spanTable.delSpan(gid)
+	return func() { spanTable.setEntry(gid, prev) }
+}
+
+func TestTraceTokenRun(t *testing.T) {
+	defer saveCurEntry()()
+	outer, inner := newSampledSpan("outer"), newSampledSpan("inner")
+	spanTable.addSpan(runtime.Getgid(), outer)
+
+	ran := false
+	newTraceToken(spanEntry{span: inner}).Run(func() {
+		ran = true
+		if cur := getCurTrace(); cur.span != inner {
+			t.Errorf("span in Run = %v; want inner", cur.span)
+		}
+	})
+	if !ran {
+		t.Fatal("fun not run")
+	}
+	if cur := getCurTrace(); cur.span != outer {
+		t.Errorf("span after Run = %v; want outer restored", cur.span)
+	}
+
+	// 没采样的请求也能传
+	u := &unsampledTrace{traceId: "463ac35c9f6413ad", spanId: "48485a3953bb6124"}
+	newTraceToken(spanEntry{unsampled: u}).Run(func() {
+		if traceId, spanId, sampled := CurrentTraceIds(); traceId != u.traceId || spanId != u.spanId || sampled {
+			t.Errorf("CurrentTraceIds in Run = %s, %s, %v; want %s, %s, false", traceId, spanId, sampled, u.traceId, u.spanId)
+		}
+	})
+
+	// nil 直接执行
+	ran = false
+	var nilToken *TraceToken
+	nilToken.Run(func() { ran = true })
+	if !ran {
+		t.Error("fun not run with a nil TraceToken")
+	}
+	if cur := getCurTrace(); cur.span != outer {
+		t.Errorf("span after nil Run = %v; want outer", cur.span)
+	}
+}
+
+func TestTraceTokenBind(t *testing.T) {
+	defer saveCurEntry()()
+	span := newSampledSpan("bound")
+	tok := newTraceToken(spanEntry{span: span})
+	tok.Bind()
+	if cur := getCurTrace(); cur.span != span {
+		t.Errorf("span after Bind = %v; want bound", cur.span)
+	}
+	if got := CaptureTraceToken(); got == nil || got.e.span != span {
+		t.Errorf("CaptureTraceToken after Bind = %+v; want bound", got)
+	}
+	UnbindTraceToken()
+	if cur := getCurTrace(); !cur.empty() {
+		t.Errorf("entry after UnbindTraceToken = %+v; want empty", cur)
+	}
+	if got := CaptureTraceToken(); got != nil {
+		t.Errorf("CaptureTraceToken without a span = %+v; want nil", got)
+	}
+	var nilToken *TraceToken
+	nilToken.Bind()
+	if cur := getCurTrace(); !cur.empty() {
+		t.Errorf("entry after nil Bind = %+v; want empty", cur)
+	}
+}
+
+func TestCaptureTraceTokenContext(t *testing.T) {
+	defer saveCurEntry()()
+	gspan, cspan := newSampledSpan("goroutine"), newSampledSpan("ctx")
+	u := &unsampledTrace{traceId: "463ac35c9f6413ad", spanId: "48485a3953bb6124"}
+	bg := context.Background()
+
+	if tok := CaptureTraceTokenContext(bg); tok != nil {
+		t.Errorf("no span anywhere: token = %+v; want nil", tok)
+	}
+	spanTable.addSpan(runtime.Getgid(), gspan)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want spanEntry
+	}{
+		{"span in ctx", context.WithValue(bg, traceSpanContextKey, cspan), spanEntry{span: cspan}},
+		{"unsampled in ctx", context.WithValue(bg, traceSpanContextKey, u), spanEntry{unsampled: u}},
+		{"empty ctx", bg, spanEntry{span: gspan}},
+	}
+	for _, tt := range tests {
+		tok := CaptureTraceTokenContext(tt.ctx)
+		if tok == nil || tok.e != tt.want {
+			t.Errorf("%s: token = %+v; want %+v", tt.name, tok, tt.want)
+		}
+	}
+}
+
+// span 里有没有 value 这个 annotation
+func hasAnnotation(s *traceSpan, value string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.Annotation {
+		if a.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStartSpan(t *testing.T) {
+	defer saveCurEntry()()
+	spans, stop := captureSpans()
+	defer stop()
+
+	// 不在 span 里新开一个 trace
+	root := StartSpan("root")
+	if root == nil {
+		t.Fatal("StartSpan returned nil")
+	}
+	if !root.span.isRoot || root.span.ParentId != "" || spanTag(root.span, "trace.root") != "true" {
+		t.Errorf("root span: isRoot=%v parent=%q trace.root=%q", root.span.isRoot, root.span.ParentId, spanTag(root.span, "trace.root"))
+	}
+	root.span.isSample = true // 不管自适应采样
+
+	child := StartSpan("child")
+	if cur := getCurTrace(); cur.span != child.span {
+		t.Errorf("current span = %v; want child", cur.span)
+	}
+	if child.span.TraceId != root.span.TraceId || child.span.ParentId != root.span.SpanId || child.span.isRoot {
+		t.Errorf("child trace=%s parent=%s root=%v; want trace=%s parent=%s root=false",
+			child.span.TraceId, child.span.ParentId, child.span.isRoot, root.span.TraceId, root.span.SpanId)
+	}
+	if spanTag(child.span, "lc") != execName {
+		t.Errorf("child lc = %q; want %q", spanTag(child.span, "lc"), execName)
+	}
+	child.SetName("renamed")
+	child.Finish()
+	child.Finish() // 第二次不记录
+	child.SetName("after finish")
+	if cur := getCurTrace(); cur.span != root.span {
+		t.Errorf("current span after child Finish = %v; want root", cur.span)
+	}
+	root.Finish()
+	if cur := getCurTrace(); !cur.empty() {
+		t.Errorf("current entry after root Finish = %+v; want empty", cur)
+	}
+
+	got := waitSpans(t, spans, 2)
+	if got[0] != child.span || got[1] != root.span {
+		t.Fatalf("recorded %s, %s; want renamed, root", got[0].Name, got[1].Name)
+	}
+	if got[0].Name != "renamed" {
+		t.Errorf("child name = %q; want renamed", got[0].Name)
+	}
+	select {
+	case s := <-spans:
+		t.Errorf("span %s recorded again", s.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStartRemoteSpan(t *testing.T) {
+	defer saveCurEntry()()
+	spans, stop := captureSpans()
+	defer stop()
+	parent := newSampledSpan("parent")
+	parent.flags = "1"
+	spanTable.addSpan(runtime.Getgid(), parent)
+
+	s := StartRemoteSpan("GET redis", "redis", "10.0.0.1:6379")
+	if s == nil {
+		t.Fatal("StartRemoteSpan returned nil")
+	}
+	h := map[string]string{}
+	s.Propagate(func(key, value string) { h[key] = value })
+	want := map[string]string{
+		FIELD_TRACE_ID:  parent.TraceId,
+		FIELD_SPAN_ID:   s.span.SpanId,
+		FIELD_PARENT_ID: parent.SpanId,
+		FIELD_SIMPLE:    "true",
+		FIELD_FLAGS:     "1",
+	}
+	for k, v := range want {
+		if h[k] != v {
+			t.Errorf("Propagate %s = %q; want %q", k, h[k], v)
+		}
+	}
+	s.Finish()
+
+	got := waitSpans(t, spans, 1)[0]
+	if got != s.span || !hasAnnotation(got, "cs") || !hasAnnotation(got, "cr") {
+		t.Errorf("remote span %s: cs=%v cr=%v", got.Name, hasAnnotation(got, "cs"), hasAnnotation(got, "cr"))
+	}
+	got.Lock()
+	var sa *binAnnotation
+	for i := range got.BinAnnotation {
+		if got.BinAnnotation[i].Key == "sa" {
+			sa = &got.BinAnnotation[i]
+		}
+	}
+	got.Unlock()
+	if sa == nil || sa.Endpoint.ServiceName != "redis" || sa.Endpoint.Ipv4 != "10.0.0.1" || sa.Endpoint.Port != 6379 {
+		t.Errorf("sa = %+v; want redis 10.0.0.1:6379", sa)
+	}
+}
+
+// 没采样的请求里只 Propagate, 每次生成新的 span id
+func TestStartRemoteSpanUnsampled(t *testing.T) {
+	defer saveCurEntry()()
+	// 没采样的请求 Bind 到当前协程上
+	u := &unsampledTrace{traceId: "463ac35c9f6413ad", spanId: "48485a3953bb6124", flags: "1"}
+	spanTable.setEntry(runtime.Getgid(), spanEntry{unsampled: u})
+
+	if s := StartSpan("local"); s != nil {
+		t.Errorf("StartSpan in an unsampled request = %+v; want nil", s)
+	}
+	s := StartRemoteSpan("GET redis", "redis", "10.0.0.1:6379")
+	if s == nil {
+		t.Fatal("StartRemoteSpan returned nil")
+	}
+	h := map[string]string{}
+	s.Propagate(func(key, value string) { h[key] = value })
+	if h[FIELD_TRACE_ID] != u.traceId || h[FIELD_PARENT_ID] != u.spanId || h[FIELD_SIMPLE] != "false" || h[FIELD_FLAGS] != "1" {
+		t.Errorf("Propagate = %v; want trace %s, parent %s, sample false, flags 1", h, u.traceId, u.spanId)
+	}
+	if id := h[FIELD_SPAN_ID]; id == "" || id == u.spanId {
+		t.Errorf("Propagate span id = %q; want a new id", id)
+	}
+	// 没有 span, 什么都不做
+	s.SetName("x")
+	s.SetTag("k", "v")
+	s.Finish()
+	if cur := getCurTrace(); cur.unsampled != u {
+		t.Errorf("current entry after Finish = %+v; want the unsampled request", cur)
+	}
+}
+
+// 测试用的 server span 和它下面的本地 span, 不采样, logTrace 不交给 reporter
+func newRequestSpans() (server, local *traceSpan) {
+	server = newSampledSpan("GET")
+	server.isSample = false
+	server.isRecvReq = true
+	local = newTraceSpan()
+	local.SpanId = genSpanId()
+	local.fromParentSpan(server)
+	server.addChildSpan(local)
+	return server, local
+}
+
+func TestAddRequestTag(t *testing.T) {
+	defer saveCurEntry()()
+	if AddRequestTag("k", "v") || AddRequestEvent("e") {
+		t.Error("added to a request outside of any request")
+	}
+
+	server, local := newRequestSpans()
+	// 当前协程在本地 span 里, 加到 server span 上
+	spanTable.addSpan(runtime.Getgid(), local)
+	if !AddRequestTag("cache.hit", "true") || !AddRequestEvent("retrying") {
+		t.Fatal("AddRequestTag/AddRequestEvent returned false inside a request")
+	}
+	// 协程链上的子协程也能找到
+	done := make(chan bool)
+	go func() {
+		done <- AddRequestTag("child", "true")
+	}()
+	if !<-done {
+		t.Error("AddRequestTag returned false in a child goroutine")
+	}
+	if spanTag(server, "cache.hit") != "true" || spanTag(server, "child") != "true" || !hasAnnotation(server, "retrying") {
+		t.Errorf("server span tags: cache.hit=%q child=%q retrying=%v",
+			spanTag(server, "cache.hit"), spanTag(server, "child"), hasAnnotation(server, "retrying"))
+	}
+	if spanTag(local, "cache.hit") != "" {
+		t.Error("tag added to the local span")
+	}
+
+	// server span 记录以后返回 false
+	logTrace(server)
+	if AddRequestTag("late", "true") || AddRequestEvent("late") {
+		t.Error("added to a recorded server span")
+	}
+	if spanTag(server, "late") != "" {
+		t.Error("late tag added to the recorded server span")
+	}
+
+	// Bind 的没采样的请求
+	spanTable.setEntry(runtime.Getgid(), spanEntry{unsampled: &unsampledTrace{traceId: "463ac35c9f6413ad", spanId: "48485a3953bb6124"}})
+	if AddRequestTag("k", "v") || AddRequestEvent("e") {
+		t.Error("added to an unsampled request")
+	}
+}
+
+func TestAddRequestTagContext(t *testing.T) {
+	defer saveCurEntry()()
+	server, local := newRequestSpans()
+	other, _ := newRequestSpans()
+	// 协程链上是另一个请求, ctx 优先
+	spanTable.addSpan(runtime.Getgid(), other)
+
+	ctx := context.WithValue(context.Background(), traceSpanContextKey, local)
+	if !AddRequestTagContext(ctx, "ctx", "true") || !AddRequestEventContext(ctx, "ctx-event") {
+		t.Fatal("AddRequestTagContext/AddRequestEventContext returned false")
+	}
+	if spanTag(server, "ctx") != "true" || !hasAnnotation(server, "ctx-event") {
+		t.Errorf("server span: ctx=%q ctx-event=%v", spanTag(server, "ctx"), hasAnnotation(server, "ctx-event"))
+	}
+	if spanTag(other, "ctx") != "" || hasAnnotation(other, "ctx-event") {
+		t.Error("added to the request on the goroutine chain instead of the ctx one")
+	}
+
+	// ctx 里没有, 找协程链
+	if !AddRequestTagContext(context.Background(), "chain", "true") || spanTag(other, "chain") != "true" {
+		t.Error("AddRequestTagContext did not fall back to the goroutine chain")
+	}
+
+	logTrace(server)
+	if AddRequestTagContext(ctx, "late", "true") || AddRequestEventContext(ctx, "late") {
+		t.Error("added to a recorded server span through ctx")
+	}
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tracer 自己的开销, 每秒清零
+var traceOverhead struct {
+	allocated int64 // atomic, newTraceSpan 的次数
+	reported  int64 // atomic, 进了 spansChan 的 span 个数
+	process   int64 // atomic, 记录 span 的协程处理, 序列化, 上报用的纳秒数
+}
+
+//
+func addTraceProcessTime(start time.Time) {
+	atomic.AddInt64(&traceOverhead.process, int64(time.Since(start)))
+}
+
+// TraceBudget 是 tracer 自己的开销上限, 任何一个超过时自动降低新开 trace 的采样率,
+// 开销都降到上限的一半以下后再慢慢升回去. 开销分两部分: 请求路径上新建 span, 加 annotation,
+// 用 MaxSpansAllocatedPerSecond 限制; 记录 span 的协程处理, 序列化, 上报,
+// 用 MaxSpansPerSecond 和 MaxReporterBusyFraction 限制
+type TraceBudget struct {
+	MaxSpansPerSecond          int     // 每秒最多报告多少 span, 0 不限
+	MaxSpansAllocatedPerSecond int     // 每秒最多新建多少 span, 包括 tail sampling 最后丢掉的, 0 不限
+	MaxReporterBusyFraction    float64 // 记录 span 的协程忙碌时间占墙上时间的比例上限, 比如 0.01, 0 不限
+	MinSampleRate              float64 // 采样率最低降到多少, 0 表示 0.001
+}
+
+// TraceOverheadStats 是上一秒 tracer 自己的开销
+type TraceOverheadStats struct {
+	SampleRate     float64       // 现在的自适应采样率, 没设置 TraceBudget 时为 1
+	SpansAllocated int64         // 请求路径上新建的 span 个数, 包括 tail sampling 最后丢掉的
+	SpansReported  int64         // 报告的 span 个数
+	ProcessTime    time.Duration // 记录 span 的协程处理, 序列化, 上报用的时间
+	QueueDepth     int           // 还没处理的 span 个数
+}
+
+var traceBudget struct {
+	budget  *TraceBudget
+	rate    float64
+	stats   TraceOverheadStats
+	running bool
+	sync.Mutex
+}
+
+func init() {
+	traceBudget.rate = 1
+	traceBudget.stats.SampleRate = 1
+}
+
+// SetTraceBudget 设置 tracer 的开销上限, nil 关闭自适应采样, 采样率恢复为 1
+func SetTraceBudget(b *TraceBudget) {
+	traceBudget.Lock()
+	defer traceBudget.Unlock()
+	traceBudget.budget = b
+	if b == nil {
+		traceBudget.rate = 1
+		return
+	}
+	if !traceBudget.running {
+		traceBudget.running = true
+		go runTraceBudget()
+	}
+}
+
+// GetTraceOverhead 返回上一秒 tracer 自己的开销, 设置过 TraceBudget 之后才每秒更新
+func GetTraceOverhead() TraceOverheadStats {
+	traceBudget.Lock()
+	defer traceBudget.Unlock()
+	return traceBudget.stats
+}
+
+// 按自适应采样率决定新开的 trace 要不要记录
+func sampleAdaptive() bool {
+	traceBudget.Lock()
+	rate := traceBudget.rate
+	traceBudget.Unlock()
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// 每秒看一次开销, 调整采样率
+func runTraceBudget() {
+	last := time.Now()
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+
+		stats := TraceOverheadStats{
+			SpansAllocated: atomic.SwapInt64(&traceOverhead.allocated, 0),
+			SpansReported:  atomic.SwapInt64(&traceOverhead.reported, 0),
+			ProcessTime:    time.Duration(atomic.SwapInt64(&traceOverhead.process, 0)),
+			QueueDepth:     len(spansChan),
+		}
+
+		traceBudget.Lock()
+		if b := traceBudget.budget; b != nil {
+			traceBudget.rate = b.adjust(traceBudget.rate, stats, elapsed)
+		}
+		stats.SampleRate = traceBudget.rate
+		traceBudget.stats = stats
+		traceBudget.Unlock()
+	}
+}
+
+// 超过上限减半, 不到上限的一半时升 1.5 倍
+func (b *TraceBudget) adjust(rate float64, stats TraceOverheadStats, elapsed time.Duration) float64 {
+	over := stats.QueueDepth > cap(spansChan)/2
+	under := stats.QueueDepth < cap(spansChan)/4
+	// max <= 0 不限
+	limit := func(v, max float64) {
+		if max > 0 {
+			over = over || v > max
+			under = under && v < max/2
+		}
+	}
+	limit(float64(stats.SpansReported)/elapsed.Seconds(), float64(b.MaxSpansPerSecond))
+	limit(float64(stats.SpansAllocated)/elapsed.Seconds(), float64(b.MaxSpansAllocatedPerSecond))
+	limit(float64(stats.ProcessTime)/float64(elapsed), b.MaxReporterBusyFraction)
+
+	minRate := b.MinSampleRate
+	if minRate <= 0 {
+		minRate = 0.001
+	}
+	switch {
+	case over:
+		rate /= 2
+	case under:
+		rate *= 1.5
+	}
+	if rate < minRate {
+		rate = minRate
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	return rate
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraceBudgetAdjust(t *testing.T) {
+	queue := cap(spansChan)
+	tests := []struct {
+		name  string
+		b     TraceBudget
+		rate  float64
+		stats TraceOverheadStats
+		want  float64
+	}{
+		{"idle stays at 1", TraceBudget{MaxSpansPerSecond: 100}, 1, TraceOverheadStats{}, 1},
+		{"idle goes up", TraceBudget{MaxSpansPerSecond: 100}, 0.5, TraceOverheadStats{SpansReported: 10}, 0.75},
+		{"spans over", TraceBudget{MaxSpansPerSecond: 100}, 1, TraceOverheadStats{SpansReported: 101}, 0.5},
+		{"spans in between", TraceBudget{MaxSpansPerSecond: 100}, 0.5, TraceOverheadStats{SpansReported: 80}, 0.5},
+		{"busy over", TraceBudget{MaxReporterBusyFraction: 0.01}, 1, TraceOverheadStats{ProcessTime: 20 * time.Millisecond}, 0.5},
+		{"busy under", TraceBudget{MaxReporterBusyFraction: 0.01}, 0.5, TraceOverheadStats{ProcessTime: time.Millisecond}, 0.75},
+		{"busy in between", TraceBudget{MaxReporterBusyFraction: 0.01}, 0.5, TraceOverheadStats{ProcessTime: 8 * time.Millisecond}, 0.5},
+		{"allocated over", TraceBudget{MaxSpansAllocatedPerSecond: 1000}, 1, TraceOverheadStats{SpansAllocated: 1001, SpansReported: 1}, 0.5},
+		{"allocated under", TraceBudget{MaxSpansAllocatedPerSecond: 1000}, 0.5, TraceOverheadStats{SpansAllocated: 100}, 0.75},
+		{"allocated in between", TraceBudget{MaxSpansAllocatedPerSecond: 1000}, 0.5, TraceOverheadStats{SpansAllocated: 800}, 0.5},
+		// tail sampling 丢掉大部分, 报告的少, 新建的多也要降
+		{"allocated over, reported under", TraceBudget{MaxSpansPerSecond: 100, MaxSpansAllocatedPerSecond: 1000}, 1,
+			TraceOverheadStats{SpansAllocated: 5000, SpansReported: 10}, 0.5},
+		{"queue over", TraceBudget{}, 1, TraceOverheadStats{QueueDepth: queue/2 + 1}, 0.5},
+		{"queue in between", TraceBudget{}, 0.5, TraceOverheadStats{QueueDepth: queue / 3}, 0.5},
+		{"either limit over", TraceBudget{MaxSpansPerSecond: 100, MaxReporterBusyFraction: 0.01}, 1,
+			TraceOverheadStats{SpansReported: 10, ProcessTime: 20 * time.Millisecond}, 0.5},
+		{"both limits under", TraceBudget{MaxSpansPerSecond: 100, MaxReporterBusyFraction: 0.01}, 0.5,
+			TraceOverheadStats{SpansReported: 10, ProcessTime: time.Millisecond}, 0.75},
+		{"default floor", TraceBudget{MaxSpansPerSecond: 1}, 0.0015, TraceOverheadStats{SpansReported: 10}, 0.001},
+		{"MinSampleRate floor", TraceBudget{MaxSpansPerSecond: 1, MinSampleRate: 0.1}, 0.15, TraceOverheadStats{SpansReported: 10}, 0.1},
+	}
+	for _, tt := range tests {
+		if got := tt.b.adjust(tt.rate, tt.stats, time.Second); got != tt.want {
+			t.Errorf("%s: adjust(%v, %+v) = %v; want %v", tt.name, tt.rate, tt.stats, got, tt.want)
+		}
+	}
+
+	// 按 elapsed 换算成每秒
+	b := TraceBudget{MaxSpansPerSecond: 100}
+	if got := b.adjust(1, TraceOverheadStats{SpansReported: 150}, 2*time.Second); got != 1 {
+		t.Errorf("150 spans in 2s: adjust = %v; want 1", got)
+	}
+}
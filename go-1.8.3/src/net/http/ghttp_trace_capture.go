@@ -0,0 +1,277 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 要记录到 span 上的头
+var spanHeaders struct {
+	req    []string
+	resp   []string
+	maxLen int
+	sync.Mutex
+}
+
+// SetSpanHeaders 设置要记录到 span 上的请求头和响应头, 比如 User-Agent, Content-Type,
+// 记为 http.request.header.<小写名字> 和 http.response.header.<小写名字>,
+// 值最多 maxLen 字节, maxLen <= 0 不截断. 带凭证的头只记 "redacted", 见 SetHeaderRedaction
+func SetSpanHeaders(reqHeaders, respHeaders []string, maxLen int) {
+	spanHeaders.Lock()
+	spanHeaders.req = append([]string(nil), reqHeaders...)
+	spanHeaders.resp = append([]string(nil), respHeaders...)
+	spanHeaders.maxLen = maxLen
+	spanHeaders.Unlock()
+}
+
+// 记录请求头
+func addReqHeaderAnnotations(span *traceSpan, ep *endpoint, h Header) {
+	spanHeaders.Lock()
+	names, maxLen := spanHeaders.req, spanHeaders.maxLen
+	spanHeaders.Unlock()
+	addHeaderAnnotations(span, ep, h, "http.request.header.", names, maxLen)
+}
+
+// 记录响应头
+func addRespHeaderAnnotations(span *traceSpan, ep *endpoint, h Header) {
+	spanHeaders.Lock()
+	names, maxLen := spanHeaders.resp, spanHeaders.maxLen
+	spanHeaders.Unlock()
+	addHeaderAnnotations(span, ep, h, "http.response.header.", names, maxLen)
+}
+
+//
+func addHeaderAnnotations(span *traceSpan, ep *endpoint, h Header, prefix string, names []string, maxLen int) {
+	if h == nil {
+		return
+	}
+	for _, name := range names {
+		key := CanonicalHeaderKey(name)
+		vs, ok := h[key]
+		if !ok {
+			continue
+		}
+		v := strings.Join(vs, ",")
+		if redactHeader(key) {
+			v = redactedValue
+		} else if maxLen > 0 && len(v) > maxLen {
+			v = v[:maxLen]
+		}
+		span.addBinAnnotation(ep, prefix+strings.ToLower(name), v)
+	}
+}
+
+// ------------------------------------------------------------------------------------
+// 出错时记录 body
+
+const (
+	bodyCaptureStatus = 500 // 状态码 >= 这个才记录 body
+)
+
+var (
+	bodyCaptureLen = 0
+	// 调用方一直不读完也不 Close resp.Body 时, 过这么久也记录 client span
+	bodyCaptureTimeout = time.Minute
+)
+
+// SetBodyCapture 打开后, 状态码 >= 500 的 server span 和 client span 记录请求和响应 body
+// 的前 n 个字节 (http.request.body, http.response.body), n <= 0 关闭.
+// server 只记录 handler 读到和写出的部分, client 的请求 body 需要 Request.GetBody,
+// client 的响应 body 只记录调用方读到的部分, 这样的 client span 在 resp.Body 读完或者
+// Close 之后才记录, 一分钟内都没有的, 记下 http.response.body.error 之后记录
+func SetBodyCapture(n int) {
+	bodyCaptureLen = n
+}
+
+// 记下 body 的前 max 个字节
+type bodySnippet struct {
+	buf []byte
+	max int
+	sync.Mutex
+}
+
+//
+func newBodySnippet(max int) *bodySnippet {
+	return &bodySnippet{max: max}
+}
+
+// p 为 nil 时记 s
+func (b *bodySnippet) write(p []byte, s string) {
+	b.Lock()
+	defer b.Unlock()
+	n := b.max - len(b.buf)
+	if n <= 0 {
+		return
+	}
+	if p != nil {
+		if len(p) > n {
+			p = p[:n]
+		}
+		b.buf = append(b.buf, p...)
+	} else {
+		if len(s) > n {
+			s = s[:n]
+		}
+		b.buf = append(b.buf, s...)
+	}
+}
+
+//
+func (b *bodySnippet) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return string(b.buf)
+}
+
+// 包装 server 的 req.Body, 记下 handler 读了多少字节, 以及读到的前几个字节
+type traceReqBody struct {
+	n       int64        // atomic, 放在第一个保证 32 位平台上 8 字节对齐
+	snippet *bodySnippet // 没打开 SetBodyCapture 时为 nil
+	io.ReadCloser
+}
+
+//
+func (b *traceReqBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&b.n, int64(n))
+		if b.snippet != nil {
+			b.snippet.write(p[:n], "")
+		}
+	}
+	return
+}
+
+// server 按 req.Body 的类型判断连接状态 (expectContinueReader, body), 要去掉包装
+func unwrapTraceReqBody(rc io.ReadCloser) io.ReadCloser {
+	if b, ok := rc.(*traceReqBody); ok {
+		return b.ReadCloser
+	}
+	return rc
+}
+
+// onHttpProcRecvReq 时包装 req.Body, server 判断 body 类型的地方用 unwrapTraceReqBody
+func wrapServerReqBody(resp *response) {
+	n := bodyCaptureLen
+	if n > 0 {
+		resp.traceBody = newBodySnippet(n)
+	}
+	if resp.req.Body != nil && resp.req.Body != NoBody {
+		b := &traceReqBody{ReadCloser: resp.req.Body}
+		if n > 0 {
+			b.snippet = newBodySnippet(n)
+		}
+		resp.req.Body = b
+	}
+}
+
+// onHttpSendResp 时恢复 req.Body, server 后面还要用它判断连接能不能复用,
+// 记录状态码, 请求和响应的大小, 出错时的 body
+func addServerRespAnnotations(resp *response, span *traceSpan, ep *endpoint) {
+	read := int64(0)
+	reqBody := ""
+	if b, ok := resp.req.Body.(*traceReqBody); ok {
+		resp.req.Body = b.ReadCloser
+		read = atomic.LoadInt64(&b.n)
+		if b.snippet != nil {
+			reqBody = b.snippet.String()
+		}
+	}
+
+	status := resp.status
+	if status == 0 {
+		status = StatusOK
+	}
+	span.addBinAnnotation(ep, "http.status_code", strconv.Itoa(status))
+	// handler 实际读到的字节数, 没读完的 body 和 Content-Length 对不上, Content-Length 另外记
+	span.addBinAnnotation(ep, "http.request.size", strconv.FormatInt(read, 10))
+	if resp.req.ContentLength > 0 {
+		span.addBinAnnotation(ep, "http.request.content_length", strconv.FormatInt(resp.req.ContentLength, 10))
+	}
+	span.addBinAnnotation(ep, "http.response.size", strconv.FormatInt(resp.written, 10))
+
+	if resp.traceBody != nil {
+		if status >= bodyCaptureStatus {
+			span.addBinAnnotation(ep, "http.request.body", reqBody)
+			span.addBinAnnotation(ep, "http.response.body", resp.traceBody.String())
+		}
+		resp.traceBody = nil
+	}
+}
+
+// client 收到出错的响应时记录 body. 响应 body 不在这里读, 包装起来,
+// 调用方读的时候记下前几个字节, 读到 EOF, 出错或者 Close 时再记录 span.
+// 返回 true 表示 span 交给 resp.Body 记录
+func wrapClientRespBody(resp *Response, span *traceSpan, ep *endpoint) bool {
+	n := bodyCaptureLen
+	if n <= 0 || resp.StatusCode < bodyCaptureStatus {
+		return false
+	}
+
+	if req := resp.Request; req != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			buf := make([]byte, n)
+			m, _ := io.ReadFull(body, buf)
+			body.Close()
+			span.addBinAnnotation(ep, "http.request.body", string(buf[:m]))
+		}
+	}
+
+	if resp.Body == nil || resp.Body == NoBody {
+		return false
+	}
+	b := &traceRespBody{ReadCloser: resp.Body, span: span, ep: ep, snippet: newBodySnippet(n)}
+	timeout := bodyCaptureTimeout
+	b.timer = time.AfterFunc(timeout, func() {
+		b.finish(fmt.Errorf("body not read to the end or closed within %v", timeout))
+	})
+	resp.Body = b
+	return true
+}
+
+// 包装 client 的 resp.Body, 记下调用方读到的前几个字节
+type traceRespBody struct {
+	io.ReadCloser
+	span    *traceSpan
+	ep      *endpoint
+	snippet *bodySnippet
+	timer   *time.Timer // 超时也记录
+	once    sync.Once
+}
+
+//
+func (b *traceRespBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.snippet.write(p[:n], "")
+	}
+	if err != nil {
+		b.timer.Stop()
+		b.finish(err)
+	}
+	return
+}
+
+//
+func (b *traceRespBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timer.Stop()
+	b.finish(nil)
+	return err
+}
+
+// 只记录一次, 超时后再读到的不记
+func (b *traceRespBody) finish(err error) {
+	b.once.Do(func() {
+		b.span.addBinAnnotation(b.ep, "http.response.body", b.snippet.String())
+		if err != nil && err != io.EOF {
+			b.span.addBinAnnotation(b.ep, "http.response.body.error", err.Error())
+		}
+		logTrace(b.span)
+	})
+}
@@ -0,0 +1,239 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddHeaderAnnotations(t *testing.T) {
+	defer SetHeaderRedaction(nil)
+	SetHeaderRedaction(nil)
+
+	h := Header{}
+	h.Add("user-agent", "curl/7.1") // Add 会规范化
+	h.Add("X-Forwarded-For", "10.0.0.1")
+	h.Add("X-Forwarded-For", "10.0.0.2")
+	h.Set("Authorization", "Bearer s3cret")
+	h.Set("X-Long", "0123456789")
+
+	tests := []struct {
+		names  []string
+		maxLen int
+		want   map[string]string
+	}{
+		// 配置的名字不区分大小写, 记录的 key 是小写
+		{[]string{"USER-AGENT", "x-forwarded-for", "X-Missing"}, 0, map[string]string{
+			"http.request.header.user-agent":      "curl/7.1",
+			"http.request.header.x-forwarded-for": "10.0.0.1,10.0.0.2",
+		}},
+		// 多个值先拼起来再截断
+		{[]string{"X-Forwarded-For", "X-Long"}, 12, map[string]string{
+			"http.request.header.x-forwarded-for": "10.0.0.1,10.",
+			"http.request.header.x-long":          "0123456789",
+		}},
+		{[]string{"X-Long"}, 4, map[string]string{
+			"http.request.header.x-long": "0123",
+		}},
+		// 带凭证的头不管 maxLen 都只记 redacted
+		{[]string{"authorization"}, 3, map[string]string{
+			"http.request.header.authorization": redactedValue,
+		}},
+	}
+	for _, tt := range tests {
+		span := newTraceSpan()
+		addHeaderAnnotations(span, &endpoint{}, h, "http.request.header.", tt.names, tt.maxLen)
+		got := map[string]string{}
+		for _, a := range span.BinAnnotation {
+			got[a.Key] = a.Value
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q, %d: tags %v; want %v", tt.names, tt.maxLen, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%q, %d: %s = %q; want %q", tt.names, tt.maxLen, k, got[k], v)
+			}
+		}
+	}
+
+	// nil 的 Header 什么都不记
+	span := newTraceSpan()
+	addHeaderAnnotations(span, &endpoint{}, nil, "http.response.header.", []string{"X-Long"}, 0)
+	if len(span.BinAnnotation) != 0 {
+		t.Errorf("tags from a nil Header: %+v", span.BinAnnotation)
+	}
+}
+
+func TestBodySnippet(t *testing.T) {
+	b := newBodySnippet(8)
+	b.write([]byte("hello"), "")
+	b.write(nil, " world")
+	b.write([]byte("more"), "")
+	if got := b.String(); got != "hello wo" {
+		t.Errorf("snippet = %q; want %q", got, "hello wo")
+	}
+}
+
+// response.write 写出的部分经过 traceBody, 这里直接写
+func TestServerBodyCapture(t *testing.T) {
+	SetBodyCapture(4)
+	defer SetBodyCapture(0)
+
+	for _, status := range []int{200, 503} {
+		resp := &response{
+			req:    &Request{Body: ioutil.NopCloser(strings.NewReader("request body"))},
+			status: status,
+		}
+		wrapServerReqBody(resp)
+		if resp.traceBody == nil {
+			t.Fatal("response body not captured")
+		}
+		buf := make([]byte, 6)
+		io.ReadFull(resp.req.Body, buf)
+		resp.traceBody.write([]byte("internal"), "")
+		resp.traceBody.write(nil, " error")
+
+		span := newTraceSpan()
+		addServerRespAnnotations(resp, span, &endpoint{})
+		if _, ok := resp.req.Body.(*traceReqBody); ok {
+			t.Errorf("%d: req.Body still wrapped", status)
+		}
+		wantReq, wantResp := "", ""
+		if status >= bodyCaptureStatus {
+			wantReq, wantResp = "requ", "inte"
+		}
+		if got := spanTag(span, "http.request.body"); got != wantReq {
+			t.Errorf("%d: http.request.body = %q; want %q", status, got, wantReq)
+		}
+		if got := spanTag(span, "http.response.body"); got != wantResp {
+			t.Errorf("%d: http.response.body = %q; want %q", status, got, wantResp)
+		}
+	}
+}
+
+// 没打开 SetBodyCapture 不记
+func TestServerBodyCaptureOff(t *testing.T) {
+	resp := &response{
+		req:    &Request{Body: ioutil.NopCloser(strings.NewReader("request body"))},
+		status: 500,
+	}
+	wrapServerReqBody(resp)
+	if resp.traceBody != nil {
+		t.Error("response body captured with SetBodyCapture(0)")
+	}
+	ioutil.ReadAll(resp.req.Body)
+	span := newTraceSpan()
+	addServerRespAnnotations(resp, span, &endpoint{})
+	if spanTag(span, "http.request.body") != "" || spanTag(span, "http.response.body") != "" {
+		t.Error("body tags recorded with SetBodyCapture(0)")
+	}
+}
+
+// 等 span 被 logTrace
+func waitFinished(t *testing.T, span *traceSpan) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		span.Lock()
+		finished := span.finished
+		span.Unlock()
+		if finished {
+			return
+		}
+	}
+	t.Fatal("span not recorded")
+}
+
+// 读出错的 body
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestClientBodyCapture(t *testing.T) {
+	SetBodyCapture(4)
+	defer SetBodyCapture(0)
+	defer func(d time.Duration) { bodyCaptureTimeout = d }(bodyCaptureTimeout)
+	bodyCaptureTimeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		use     func(body io.ReadCloser)
+		want    string
+		wantErr string // http.response.body.error 里要有的
+	}{
+		{"read to EOF", strings.NewReader("server error"), func(body io.ReadCloser) { ioutil.ReadAll(body) }, "serv", ""},
+		{"closed early", strings.NewReader("server error"), func(body io.ReadCloser) {
+			body.Read(make([]byte, 2))
+			body.Close()
+		}, "se", ""},
+		{"read error", io.MultiReader(strings.NewReader("se"), errReader{}), func(body io.ReadCloser) { ioutil.ReadAll(body) }, "se", "connection reset"},
+		{"never closed", strings.NewReader("server error"), func(body io.ReadCloser) {}, "", "not read to the end or closed"},
+	}
+	for _, tt := range tests {
+		span := newTraceSpan() // 不采样, logTrace 不交给 reporter
+		req := &Request{GetBody: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("request body")), nil
+		}}
+		resp := &Response{StatusCode: 502, Body: ioutil.NopCloser(tt.body), Request: req}
+		if !wrapClientRespBody(resp, span, &endpoint{}) {
+			t.Fatalf("%s: body not wrapped", tt.name)
+		}
+		tt.use(resp.Body)
+		waitFinished(t, span)
+		if got := spanTag(span, "http.request.body"); got != "requ" {
+			t.Errorf("%s: http.request.body = %q; want requ", tt.name, got)
+		}
+		if got := spanTag(span, "http.response.body"); got != tt.want {
+			t.Errorf("%s: http.response.body = %q; want %q", tt.name, got, tt.want)
+		}
+		got := spanTag(span, "http.response.body.error")
+		if tt.wantErr == "" && got != "" || !strings.Contains(got, tt.wantErr) {
+			t.Errorf("%s: http.response.body.error = %q; want %q", tt.name, got, tt.wantErr)
+		}
+	}
+
+	// 2xx 不包装
+	resp := &Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+	if wrapClientRespBody(resp, newTraceSpan(), &endpoint{}) {
+		t.Error("2xx body wrapped")
+	}
+}
+
+// http.request.size 是 handler 读到的, Content-Length 另外记
+func TestServerRequestSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		read          int
+		size, length  string
+	}{
+		{"read all", "hello world!", 12, 12, "12", "12"},
+		{"read part", "hello world!", 12, 5, "5", "12"},
+		{"not read", "hello world!", 12, 0, "0", "12"},
+		{"chunked", "hello world!", -1, 12, "12", ""},
+		{"no body", "", 0, 0, "0", ""},
+	}
+	for _, tt := range tests {
+		req := &Request{ContentLength: tt.contentLength, Body: NoBody}
+		if tt.body != "" {
+			req.Body = ioutil.NopCloser(strings.NewReader(tt.body))
+		}
+		resp := &response{req: req}
+		wrapServerReqBody(resp)
+		io.ReadFull(req.Body, make([]byte, tt.read))
+
+		span := newTraceSpan()
+		addServerRespAnnotations(resp, span, &endpoint{})
+		if got := spanTag(span, "http.request.size"); got != tt.size {
+			t.Errorf("%s: http.request.size = %q; want %q", tt.name, got, tt.size)
+		}
+		if got := spanTag(span, "http.request.content_length"); got != tt.length {
+			t.Errorf("%s: http.request.content_length = %q; want %q", tt.name, got, tt.length)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package http_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	. "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trace 包装了 req.Body 之后, server 照样按 expectContinueReader 处理 Expect: 100-continue
+func TestTraceExpectContinue(t *testing.T) {
+	SetSpanReporter(discardSpanReporter{})
+	defer SetSpanReporter(nil)
+	SetBodyCapture(16)
+	defer SetBodyCapture(0)
+
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/read" {
+			io.Copy(w, r.Body)
+		}
+	}))
+	defer ts.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// handler 读 body 时先回 100 Continue
+	conn, br := dial()
+	defer conn.Close()
+	io.WriteString(conn, "POST /read HTTP/1.1\r\nHost: foo\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	res, err := ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != StatusContinue {
+		t.Fatalf("first response status = %d; want 100", res.StatusCode)
+	}
+	io.WriteString(conn, "hello")
+	res, err = ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "hello" || res.StatusCode != StatusOK {
+		t.Errorf("response = %d %q, %v; want 200 \"hello\"", res.StatusCode, body, err)
+	}
+	if res.Close {
+		t.Errorf("connection closed after the body was read")
+	}
+
+	// handler 不读 body, 不回 100 Continue, 回应后关掉连接
+	conn2, br2 := dial()
+	defer conn2.Close()
+	io.WriteString(conn2, "POST /skip HTTP/1.1\r\nHost: foo\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	res, err = ReadResponse(br2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusOK {
+		t.Errorf("status = %d; want 200 without 100 Continue", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("connection kept open with the request body unread")
+	}
+}
+
+// 5xx 时 server span 记下 handler 读到的请求 body 和 response.write 写出的响应 body,
+// client span 记下调用方读到的响应 body
+func TestTraceBodyCapture(t *testing.T) {
+	SetSpanReporter(discardSpanReporter{})
+	defer SetSpanReporter(nil)
+	SetBodyCapture(8)
+	defer SetBodyCapture(0)
+
+	type bodies struct{ req, resp string }
+	server, client := make(chan bodies, 1), make(chan bodies, 1)
+	AddSpanProcessor(func(r *SpanRecord) bool {
+		if url, _ := r.Tag("http.url"); !strings.HasSuffix(url, "/body-capture") {
+			return true
+		}
+		req, _ := r.Tag("http.request.body")
+		resp, _ := r.Tag("http.response.body")
+		ch := client
+		if r.IsServer() {
+			ch = server
+		}
+		select {
+		case ch <- bodies{req, resp}:
+		default:
+		}
+		return true
+	})
+
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(StatusInternalServerError)
+		io.WriteString(w, "internal ")
+		w.Write([]byte("error details"))
+	}))
+	defer ts.Close()
+
+	res, err := Post(ts.URL+"/body-capture", "text/plain", strings.NewReader("request body here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	want := bodies{"request ", "internal"}
+	for _, tt := range []struct {
+		name string
+		ch   chan bodies
+	}{{"server", server}, {"client", client}} {
+		select {
+		case got := <-tt.ch:
+			if got != want {
+				t.Errorf("%s span bodies = %+v; want %+v", tt.name, got, want)
+			}
+		case <-time.After(15 * time.Second):
+			t.Errorf("%s span not recorded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package http
+
+import (
+	"runtime"
+	"strconv"
+)
+
+// runtime/trace 打开时把 span 的开始和结束写进 execution trace, go tool trace 的 /spans 页面
+// 按 trace id, span id 列出来, 链接到协程的调度细节. 没打开时只多读一个变量
+func traceExecSpanStart(kind int, span *traceSpan) {
+	if !runtime.TraceEnabled() {
+		return
+	}
+	high, low := parseTraceIdHex(span.TraceId)
+	runtime.TraceSpanStart(kind, high, low, parseIdHex(span.SpanId))
+}
+
+//
+func traceExecSpanEnd(span *traceSpan) {
+	if !runtime.TraceEnabled() {
+		return
+	}
+	runtime.TraceSpanEnd(parseIdHex(span.SpanId))
+}
+
+// 16 或 32 个 16 进制字符, 64 位的 high 为 0
+func parseTraceIdHex(id string) (high, low uint64) {
+	if len(id) > 16 {
+		high = parseIdHex(id[:len(id)-16])
+		id = id[len(id)-16:]
+	}
+	return high, parseIdHex(id)
+}
+
+// 不合法的返回 0
+func parseIdHex(id string) uint64 {
+	v, _ := strconv.ParseUint(id, 16, 64)
+	return v
+}
@@ -0,0 +1,329 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteTraceGoroutines 把协程链能找到 traceId (或 server span 的 spanId) 的协程调用栈写到 w,
+// 格式和 /debug/pprof/goroutine?debug=2 一样, 起了名字的协程前面多一行 "# name: xxx",
+// 返回写出的协程个数
+func WriteTraceGoroutines(w io.Writer, traceId, spanId string) (n int, err error) {
+	if traceId == "" && spanId == "" {
+		return 0, nil
+	}
+	return writeGoroutines(w, func(gid int64) bool {
+		span := getSpanByGid(gid)
+		return span != nil && span.match(traceId, spanId)
+	})
+}
+
+// WriteGoroutines 和 WriteTraceGoroutines 一样, 写出所有协程
+func WriteGoroutines(w io.Writer) (n int, err error) {
+	return writeGoroutines(w, func(gid int64) bool { return true })
+}
+
+//
+func writeGoroutines(w io.Writer, match func(gid int64) bool) (n int, err error) {
+	rangeGoroutineStacks(allGoroutineStacks(), func(gid int64, stack []byte) {
+		if err != nil || !match(gid) {
+			return
+		}
+		if info, ok := getGpInfo(gid); ok && info.Name != "" {
+			if _, err = w.Write([]byte("# name: " + info.Name + "\n")); err != nil {
+				return
+			}
+		}
+		if _, err = w.Write(stack); err == nil {
+			_, err = w.Write([]byte("\n"))
+			n++
+		}
+	})
+	return
+}
+
+// traceId, spanId 为空的不比较
+func (s *traceSpan) match(traceId, spanId string) bool {
+	if traceId != "" && s.TraceId != traceId {
+		return false
+	}
+	if spanId != "" && s.SpanId != spanId {
+		return false
+	}
+	return true
+}
+
+// 所有协程的调用栈, 会 stop the world, 只在 debug 时用
+func allGoroutineStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// 按协程切开 runtime.Stack 的输出, 每段以 "goroutine 18 [running]:" 开头, 空行分隔
+func rangeGoroutineStacks(b []byte, fun func(gid int64, stack []byte)) {
+	for len(b) > 0 {
+		var stack []byte
+		if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+			stack, b = b[:i+1], b[i+2:]
+		} else {
+			stack, b = b, nil
+		}
+		if gid := parseGoroutineId(stack); gid > 0 {
+			fun(gid, stack)
+		}
+	}
+}
+
+//
+func parseGoroutineId(stack []byte) int64 {
+	prefix := []byte("goroutine ")
+	if !bytes.HasPrefix(stack, prefix) {
+		return -1
+	}
+	stack = stack[len(prefix):]
+	i := bytes.IndexByte(stack, ' ')
+	if i < 0 {
+		return -1
+	}
+	gid, err := strconv.ParseInt(string(stack[:i]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return gid
+}
+
+// ------------------------------------------------------------------------------------
+// 请求处理期间 go 出去的协程
+
+// 请求处理期间同时活着的后代协程个数的最大值, ResetgPeak 之后只数这个请求创建的
+func addPeakDescendants(span *traceSpan, ep *endpoint) {
+	_, peak := runtime.Getgdescendants(span.gid)
+	span.addBinAnnotation(ep, "goroutine.peak", strconv.FormatInt(peak, 10))
+}
+
+var (
+	enableGoroutineSpan = false
+)
+
+// SetGoroutineSpan 打开后, 请求处理期间创建的协程在 server span 下各记一个本地 span,
+// 从创建到退出, name 是 runtime.SetGoroutineName 设置的名字, 没有就是协程入口函数,
+// server span 上记录 goroutine.fanout. 带 FLAG_DEBUG 的请求不管打没打开都记录.
+// 请求结束时还在运行的协程, 等它退出再记录, 超过 maxGoroutineSpanWait 还没退出的
+// 记 goroutine.running=true
+func SetGoroutineSpan(enable bool) {
+	enableGoroutineSpan = enable
+}
+
+// 把 runtime.Nanotime 的时间转成 getTraceTime 的时间
+type gpClock struct {
+	nano  int64 // runtime.Nanotime()
+	micro int64 // getTraceTime()
+}
+
+func newGpClock() gpClock {
+	return gpClock{nano: runtime.Nanotime(), micro: getTraceTime()}
+}
+
+func (c gpClock) toTraceTime(nano int64) int64 {
+	return c.micro - (c.nano-nano)/1e3
+}
+
+// 请求处理期间 gid 创建的协程, 以及这些协程的所有后代, 按创建顺序,
+// 去掉 net/http 自己的协程和它们的后代
+func getRequestGoroutines(gid int64) []runtime.GpInfo {
+	ret := []runtime.GpInfo{}
+	skip := map[int64]bool{}
+	for _, info := range runtime.CopyGpSpawned(gid) {
+		if skip[info.Pid] || isHttpGoroutine(info) {
+			skip[info.Gid] = true
+			continue
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// net/http 自己的协程, 比如 backgroundRead
+func isHttpGoroutine(info runtime.GpInfo) bool {
+	return strings.HasPrefix(goroutineFuncName(info), "net/http.")
+}
+
+//
+func goroutineFuncName(info runtime.GpInfo) string {
+	if f := runtime.FuncForPC(info.StartPC); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
+
+// 请求结束时, 给请求期间创建的协程各记一个 span,
+// blocks 不为 nil 时 (FLAG_DEBUG) 父 span 上记录每个协程的创建, 协程 span 上记录请求期间的阻塞
+func logGoroutineSpans(parent *traceSpan, goroutines []runtime.GpInfo, blocks map[int64]goroutineBlocks) {
+	clock := newGpClock()
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: parent.localPort}
+	spans := map[int64]*traceSpan{}
+	for _, info := range goroutines {
+		p, ok := spans[info.Pid]
+		if !ok {
+			p = parent
+		}
+		span := newTraceSpan()
+		span.fromParentSpan(p)
+		span.SpanId = genSpanId()
+		span.Name = goroutineFuncName(info)
+		span.Timestamp = clock.toTraceTime(info.Nano)
+		span.addBinAnnotation(ep, "lc", "goroutine")
+		span.addBinAnnotation(ep, "goroutine.id", strconv.FormatInt(info.Gid, 10))
+		if info.Name != "" {
+			span.Name = info.Name
+			span.addBinAnnotation(ep, "goroutine.func", goroutineFuncName(info))
+		}
+		if blocks != nil {
+			p.addAnnotation(ep, span.Timestamp, "goroutine.spawn "+span.Name)
+			addBlockAnnotations(span, ep, blocks[info.Gid], clock)
+		}
+		spans[info.Gid] = span
+		p.addChildSpan(span)
+	}
+	// 子协程的 span 可能还要加 goroutine.spawn, 最后再记录
+	for _, info := range goroutines {
+		if info.ExitNano > 0 {
+			logGoroutineSpan(spans[info.Gid], ep, info.ExitNano, false)
+		} else {
+			addPendingGoroutineSpan(spans[info.Gid], ep, info.Gid, clock.nano)
+		}
+	}
+	parent.addBinAnnotation(ep, "goroutine.fanout", strconv.Itoa(len(goroutines)))
+}
+
+// 请求期间一个协程记下的阻塞
+type goroutineBlocks struct {
+	events  []runtime.GBlockEvent
+	dropped int
+}
+
+// 测试时换成假的
+var stopgBlockTrace = runtime.StopgBlockTrace
+
+// 停掉请求协程和请求期间创建的协程 (包括 net/http 自己的) 的阻塞记录, 取出记下的阻塞.
+// 请求结束后还在运行的协程不再记, 没有协程在记的时候 gopark 不多做事
+func stopRequestBlocks(gid int64) map[int64]goroutineBlocks {
+	blocks := map[int64]goroutineBlocks{}
+	stop := func(gid int64) {
+		if events, dropped := stopgBlockTrace(gid); len(events) > 0 || dropped > 0 {
+			blocks[gid] = goroutineBlocks{events: events, dropped: dropped}
+		}
+	}
+	stop(gid)
+	for _, info := range runtime.CopyGpSpawned(gid) {
+		stop(info.Gid)
+	}
+	return blocks
+}
+
+// 每次阻塞记一个 "goroutine.block <reason> <耗时>", 时间是开始阻塞的时间
+func addBlockAnnotations(span *traceSpan, ep *endpoint, blocks goroutineBlocks, clock gpClock) {
+	for _, ev := range blocks.events {
+		d := time.Duration(ev.End - ev.Start)
+		span.addAnnotation(ep, clock.toTraceTime(ev.Start), "goroutine.block "+ev.Reason+" "+d.String())
+	}
+	if blocks.dropped > 0 {
+		span.addBinAnnotation(ep, "goroutine.block.dropped", strconv.Itoa(blocks.dropped))
+	}
+}
+
+// 协程 span 的 Timestamp 是创建时间, end 是 runtime.Nanotime 的时间
+func logGoroutineSpan(span *traceSpan, ep *endpoint, end int64, running bool) {
+	clock := newGpClock()
+	span.Duration = clock.toTraceTime(end) - span.Timestamp
+	if running {
+		span.addBinAnnotation(ep, "goroutine.running", "true")
+	}
+	logTrace(span)
+}
+
+const (
+	maxGoroutineSpanWait     = time.Minute // 请求结束后最多等协程退出多久
+	maxPendingGoroutineSpans = 10000
+	goroutineSpanPoll        = time.Second
+)
+
+// 请求结束时还在运行的协程
+type pendingGoroutineSpan struct {
+	span *traceSpan
+	ep   *endpoint
+	gid  int64
+	end  int64 // 请求结束时间, runtime.Nanotime
+}
+
+// 测试时换成假的
+var getGpInfo = runtime.GetGpInfo
+
+var pendingGoroutineSpans struct {
+	spans   []pendingGoroutineSpan
+	running bool
+	sync.Mutex
+}
+
+//
+func addPendingGoroutineSpan(span *traceSpan, ep *endpoint, gid, end int64) {
+	pendingGoroutineSpans.Lock()
+	full := len(pendingGoroutineSpans.spans) >= maxPendingGoroutineSpans
+	if !full {
+		pendingGoroutineSpans.spans = append(pendingGoroutineSpans.spans, pendingGoroutineSpan{span: span, ep: ep, gid: gid, end: end})
+		if !pendingGoroutineSpans.running {
+			pendingGoroutineSpans.running = true
+			go runPendingGoroutineSpans()
+		}
+	}
+	pendingGoroutineSpans.Unlock()
+
+	// 等的太多了, 不等了
+	if full {
+		logGoroutineSpan(span, ep, end, true)
+	}
+}
+
+// 定时看还在等的协程退出了没有
+func runPendingGoroutineSpans() {
+	for {
+		time.Sleep(goroutineSpanPoll)
+		pollPendingGoroutineSpans(runtime.Nanotime())
+	}
+}
+
+// 退出了的, 记录清掉了的和等太久的记录下来, 其它的接着等
+func pollPendingGoroutineSpans(now int64) {
+	pendingGoroutineSpans.Lock()
+	pending := pendingGoroutineSpans.spans
+	pendingGoroutineSpans.spans = nil
+	pendingGoroutineSpans.Unlock()
+
+	var left []pendingGoroutineSpan
+	for _, p := range pending {
+		info, ok := getGpInfo(p.gid)
+		switch {
+		case ok && info.ExitNano > 0:
+			logGoroutineSpan(p.span, p.ep, info.ExitNano, false)
+		case !ok || now-p.end > int64(maxGoroutineSpanWait):
+			logGoroutineSpan(p.span, p.ep, now, true)
+		default:
+			left = append(left, p)
+		}
+	}
+
+	pendingGoroutineSpans.Lock()
+	pendingGoroutineSpans.spans = append(left, pendingGoroutineSpans.spans...)
+	pendingGoroutineSpans.Unlock()
+}
@@ -0,0 +1,286 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var parseGoroutineIdTests = []struct {
+	stack string
+	gid   int64
+}{
+	{"goroutine 18 [running]:\nmain.main()\n", 18},
+	{"goroutine 1 [chan receive, 2 minutes]:\n", 1},
+	{"goroutine 7 [select]:", 7},
+	{"goroutine x [running]:\n", -1},
+	{"goroutine 18", -1},
+	{"main.main()\n", -1},
+	{"", -1},
+}
+
+func TestParseGoroutineId(t *testing.T) {
+	for _, tt := range parseGoroutineIdTests {
+		if got := parseGoroutineId([]byte(tt.stack)); got != tt.gid {
+			t.Errorf("parseGoroutineId(%q) = %d; want %d", tt.stack, got, tt.gid)
+		}
+	}
+}
+
+func TestRangeGoroutineStacks(t *testing.T) {
+	const g1 = "goroutine 1 [running]:\nmain.main()\n\t/tmp/main.go:10 +0x20\n"
+	const g7 = "goroutine 7 [select]:\nmain.loop()\n\t/tmp/main.go:20 +0x40\n"
+	const bad = "created by main.main\n"
+
+	tests := []struct {
+		in     string
+		gids   []int64
+		stacks []string
+	}{
+		{"", nil, nil},
+		{g1, []int64{1}, []string{g1}},
+		{g1 + "\n" + g7, []int64{1, 7}, []string{g1, g7}},
+		{g1 + "\n" + bad + "\n" + g7, []int64{1, 7}, []string{g1, g7}},
+		// runtime.Stack 截断时最后一段没有空行
+		{g1 + "\n" + g7[:20], []int64{1, 7}, []string{g1, g7[:20]}},
+	}
+
+	for _, tt := range tests {
+		var gids []int64
+		var stacks []string
+		rangeGoroutineStacks([]byte(tt.in), func(gid int64, stack []byte) {
+			gids = append(gids, gid)
+			stacks = append(stacks, string(stack))
+		})
+		if !reflect.DeepEqual(gids, tt.gids) || !reflect.DeepEqual(stacks, tt.stacks) {
+			t.Errorf("rangeGoroutineStacks(%q) = %v, %q; want %v, %q", tt.in, gids, stacks, tt.gids, tt.stacks)
+		}
+	}
+}
+
+func testGoroutineA() {}
+func testGoroutineB() {}
+
+func funcPC(f func()) uintptr {
+	return reflect.ValueOf(f).Pointer()
+}
+
+// 假的 runtime.GetGpInfo
+type fakeGpInfos struct {
+	infos map[int64]runtime.GpInfo
+	sync.Mutex
+}
+
+func (f *fakeGpInfos) get(gid int64) (runtime.GpInfo, bool) {
+	f.Lock()
+	defer f.Unlock()
+	info, ok := f.infos[gid]
+	return info, ok
+}
+
+func (f *fakeGpInfos) set(info runtime.GpInfo) {
+	f.Lock()
+	f.infos[info.Gid] = info
+	f.Unlock()
+}
+
+// Nanotime 和 getTraceTime 不是同一时刻取的, 换算有几微秒的误差
+func aboutMicros(got, want int64) bool {
+	return got > want-100 && got < want+100
+}
+
+func TestLogGoroutineSpans(t *testing.T) {
+	spans, stop := captureSpans()
+	defer stop()
+	fake := &fakeGpInfos{infos: map[int64]runtime.GpInfo{}}
+	getGpInfo = fake.get
+	defer func() { getGpInfo = runtime.GetGpInfo }()
+	// 不起后台的 runPendingGoroutineSpans, 下面自己调 pollPendingGoroutineSpans
+	pendingGoroutineSpans.Lock()
+	running := pendingGoroutineSpans.running
+	pendingGoroutineSpans.running = true
+	pendingGoroutineSpans.Unlock()
+	defer func() {
+		pendingGoroutineSpans.Lock()
+		pendingGoroutineSpans.running = running
+		pendingGoroutineSpans.Unlock()
+	}()
+
+	funcA := runtime.FuncForPC(funcPC(testGoroutineA)).Name()
+	funcB := runtime.FuncForPC(funcPC(testGoroutineB)).Name()
+	// 往后挪一点, 刚启动时 Nanotime 减几毫秒可能是负的
+	now := runtime.Nanotime() + 1e9
+	parent := newSampledSpan("GET")
+	parent.gid = 100
+	goroutines := []runtime.GpInfo{
+		{Gid: 101, Pid: 100, Nano: now - 3e6, ExitNano: now - 1e6, StartPC: funcPC(testGoroutineA)},
+		{Gid: 102, Pid: 101, Nano: now - 2e6, ExitNano: now - 1e6, StartPC: funcPC(testGoroutineB), Name: "worker"},
+		{Gid: 103, Pid: 100, Nano: now - 2e6, StartPC: funcPC(testGoroutineB)},
+		{Gid: 104, Pid: 100, Nano: now - 2e6, StartPC: funcPC(testGoroutineA)},
+	}
+	for _, info := range goroutines {
+		fake.set(info)
+	}
+	logGoroutineSpans(parent, goroutines, nil)
+	if got := spanTag(parent, "goroutine.fanout"); got != "4" {
+		t.Errorf("goroutine.fanout = %q; want 4", got)
+	}
+
+	// 退出了的马上记录, 子协程的 span 挂在父协程的 span 下面
+	byName := map[string]*traceSpan{}
+	for _, s := range waitSpans(t, spans, 2) {
+		byName[s.Name] = s
+	}
+	a, b := byName[funcA], byName["worker"]
+	if a == nil || b == nil {
+		t.Fatalf("recorded spans %v; want %s and worker", byName, funcA)
+	}
+	if a.ParentId != parent.SpanId || b.ParentId != a.SpanId || b.TraceId != parent.TraceId {
+		t.Errorf("parents: a=%s b=%s; want %s, %s", a.ParentId, b.ParentId, parent.SpanId, a.SpanId)
+	}
+	if got := spanTag(b, "goroutine.func"); got != funcB {
+		t.Errorf("worker goroutine.func = %q", got)
+	}
+	if !aboutMicros(a.Duration, 2000) {
+		t.Errorf("a duration = %dus; want 2000", a.Duration)
+	}
+
+	// 还在运行的等退出, 103 退出了, 104 还没有
+	exited := goroutines[2]
+	exited.ExitNano = now + 5e6
+	fake.set(exited)
+	pollPendingGoroutineSpans(now + 1e6)
+	s := waitSpans(t, spans, 1)[0]
+	if s.Name != funcB || spanTag(s, "goroutine.running") != "" || !aboutMicros(s.Duration, 7000) {
+		t.Errorf("exited pending span %s running=%q duration=%d", s.Name, spanTag(s, "goroutine.running"), s.Duration)
+	}
+
+	// 等太久了, 记 goroutine.running=true
+	pollPendingGoroutineSpans(runtime.Nanotime() + int64(maxGoroutineSpanWait) + 1)
+	s = waitSpans(t, spans, 1)[0]
+	if s.Name != funcA || spanTag(s, "goroutine.running") != "true" {
+		t.Errorf("timed out pending span %s running=%q", s.Name, spanTag(s, "goroutine.running"))
+	}
+	pendingGoroutineSpans.Lock()
+	left := len(pendingGoroutineSpans.spans)
+	pendingGoroutineSpans.Unlock()
+	if left != 0 {
+		t.Errorf("%d goroutine spans still pending", left)
+	}
+}
+
+// 起了名字的协程前面多一行 "# name: xxx", 没名字的不加
+func TestWriteGoroutinesName(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	gidc := make(chan int64)
+	go testLeakedGoroutine(gidc, block)
+	named := <-gidc
+	go testLeakedGoroutine(gidc, block)
+	unnamed := <-gidc
+
+	fake := &fakeGpInfos{infos: map[int64]runtime.GpInfo{}}
+	getGpInfo = fake.get
+	defer func() { getGpInfo = runtime.GetGpInfo }()
+	fake.set(runtime.GpInfo{Gid: named, Name: "worker"})
+	fake.set(runtime.GpInfo{Gid: unnamed})
+
+	var buf bytes.Buffer
+	if _, err := WriteGoroutines(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	if !strings.Contains(dump, fmt.Sprintf("# name: worker\ngoroutine %d [", named)) {
+		t.Errorf("no name line before goroutine %d:\n%s", named, dump)
+	}
+	if i := strings.Index(dump, fmt.Sprintf("goroutine %d [", unnamed)); i < 0 {
+		t.Errorf("goroutine %d not dumped:\n%s", unnamed, dump)
+	} else if strings.HasSuffix(dump[:i], "# name: \n") {
+		t.Errorf("empty name line before goroutine %d:\n%s", unnamed, dump)
+	}
+	if n := strings.Count(dump, "# name: "); n != 1 {
+		t.Errorf("%d name lines; want 1:\n%s", n, dump)
+	}
+}
+
+func TestLogGoroutineSpansVerbose(t *testing.T) {
+	spans, stop := captureSpans()
+	defer stop()
+
+	now := runtime.Nanotime() + 1e9
+	parent := newSampledSpan("GET")
+	goroutines := []runtime.GpInfo{
+		{Gid: 201, Pid: 200, Nano: now - 3e6, ExitNano: now - 1e6, StartPC: funcPC(testGoroutineA), Name: "worker"},
+	}
+	blocks := map[int64]goroutineBlocks{
+		201: {events: []runtime.GBlockEvent{{Reason: "select", Start: now - 2e6, End: now - 15e5}}, dropped: 3},
+	}
+	logGoroutineSpans(parent, goroutines, blocks)
+	s := waitSpans(t, spans, 1)[0]
+	if !hasAnnotation(parent, "goroutine.spawn worker") {
+		t.Errorf("parent annotations %+v; want goroutine.spawn worker", parent.Annotation)
+	}
+	var block *annotation
+	for i, a := range s.Annotation {
+		if a.Value == "goroutine.block select 500µs" {
+			block = &s.Annotation[i]
+		}
+	}
+	if block == nil {
+		t.Fatalf("goroutine span annotations %+v; want goroutine.block select 500µs", s.Annotation)
+	}
+	if !aboutMicros(block.Timestamp-s.Timestamp, 1000) {
+		t.Errorf("block at %dus after the goroutine started; want 1000", block.Timestamp-s.Timestamp)
+	}
+	if got := spanTag(s, "goroutine.block.dropped"); got != "3" {
+		t.Errorf("goroutine.block.dropped = %q; want 3", got)
+	}
+}
+
+func TestDebugRequestBlocks(t *testing.T) {
+	defer saveCurEntry()()
+	_, stop := captureSpans()
+	defer stop()
+
+	gid := runtime.Getgid()
+	now := runtime.Nanotime() + 1e9
+	var stopped []int64
+	stopgBlockTrace = func(id int64) ([]runtime.GBlockEvent, int) {
+		stopped = append(stopped, id)
+		if id != gid {
+			return nil, 0
+		}
+		return []runtime.GBlockEvent{{Reason: "chan receive", Start: now - 3e6, End: now - 1e6}}, 0
+	}
+	defer func() { stopgBlockTrace = runtime.StopgBlockTrace }()
+
+	// 没带 debug 的不取
+	h := Header{}
+	h.Set(FIELD_SIMPLE, "true")
+	resp := newTestResponse(h)
+	onHttpSendResp(resp, onHttpProcRecvReq(resp))
+	if len(stopped) != 0 {
+		t.Errorf("StopgBlockTrace called for a request without FLAG_DEBUG: %v", stopped)
+	}
+
+	// 不采样的也强制采样
+	h = Header{}
+	h.Set(FIELD_SIMPLE, "false")
+	h.Set(FIELD_FLAGS, "1")
+	resp = newTestResponse(h)
+	span := onHttpProcRecvReq(resp)
+	if span == nil {
+		t.Fatal("X-W-Flags: 1 request not sampled")
+	}
+	onHttpSendResp(resp, span)
+	if len(stopped) == 0 || stopped[0] != gid {
+		t.Errorf("StopgBlockTrace called for %v; want request goroutine %d first", stopped, gid)
+	}
+	if !hasAnnotation(span, "goroutine.block chan receive 2ms") {
+		t.Errorf("server span annotations %+v; want goroutine.block chan receive 2ms", span.Annotation)
+	}
+}
@@ -0,0 +1,148 @@
+package http
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdGenerator 生成 trace id 和 span id, 测试时可以换成固定的
+type IdGenerator interface {
+	SpanId() uint64
+	TraceId() (high, low uint64) // 64 位 trace id 只用 low
+}
+
+// 默认的 IdGenerator, 用 crypto/rand 做种子的 math/rand
+type randIdGenerator struct {
+	r *rand.Rand
+	sync.Mutex
+}
+
+//
+func newRandIdGenerator() *randIdGenerator {
+	seed := time.Now().UnixNano()
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err == nil {
+		seed = int64(binary.LittleEndian.Uint64(b[:]))
+	}
+	return &randIdGenerator{r: rand.New(rand.NewSource(seed))}
+}
+
+//
+func (g *randIdGenerator) SpanId() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	for {
+		if id := g.r.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+//
+func (g *randIdGenerator) TraceId() (high, low uint64) {
+	return g.SpanId(), g.SpanId()
+}
+
+var (
+	idGeneratorMu sync.Mutex
+	idGenerator   IdGenerator = newRandIdGenerator()
+	traceId128                = false
+	traceClock                = time.Now
+)
+
+// SetIdGenerator 替换生成 trace id 和 span id 的 IdGenerator, nil 恢复默认
+func SetIdGenerator(g IdGenerator) {
+	if g == nil {
+		g = newRandIdGenerator()
+	}
+	idGeneratorMu.Lock()
+	idGenerator = g
+	idGeneratorMu.Unlock()
+}
+
+// SetTraceId128 打开后新开的 trace 用 128 位 (32 个 16 进制字符) 的 trace id, 默认 64 位
+func SetTraceId128(enable bool) {
+	traceId128 = enable
+}
+
+// SetTraceClock 替换记录 span 时间用的时钟, nil 恢复成 time.Now
+func SetTraceClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	traceClock = now
+}
+
+//
+func getIdGenerator() IdGenerator {
+	idGeneratorMu.Lock()
+	defer idGeneratorMu.Unlock()
+	return idGenerator
+}
+
+// 16 个 16 进制字符
+func genSpanId() string {
+	return formatId(getIdGenerator().SpanId())
+}
+
+// 16 或 32 个 16 进制字符
+func genTraceId() string {
+	high, low := getIdGenerator().TraceId()
+	if traceId128 {
+		return formatId(high) + formatId(low)
+	}
+	return formatId(low)
+}
+
+//
+func formatId(id uint64) string {
+	const hex = "0123456789abcdef"
+	var b [16]byte
+	for i := 15; i >= 0; i-- {
+		b[i] = hex[id&0xf]
+		id >>= 4
+	}
+	return string(b[:])
+}
+
+// 收到的 trace id, 64 位或 128 位, 不够长的前面补 0, 不合法的返回 ""
+func normalizeTraceId(id string) string {
+	if len(id) > 16 {
+		return normalizeId(id, 32)
+	}
+	return normalizeId(id, 16)
+}
+
+// 收到的 span id, 64 位, 不够长的前面补 0, 不合法的返回 ""
+func normalizeSpanId(id string) string {
+	return normalizeId(id, 16)
+}
+
+//
+func normalizeId(id string, width int) string {
+	if id == "" || len(id) > width {
+		return ""
+	}
+	id = strings.ToLower(id)
+	zero := true
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return ""
+		}
+		if c != '0' {
+			zero = false
+		}
+	}
+	if zero {
+		return ""
+	}
+	if len(id) < width {
+		id = strings.Repeat("0", width-len(id)) + id
+	}
+	return id
+}
@@ -0,0 +1,81 @@
+package http
+
+import "testing"
+
+var formatIdTests = []struct {
+	id   uint64
+	want string
+}{
+	{0, "0000000000000000"},
+	{1, "0000000000000001"},
+	{0xabc, "0000000000000abc"},
+	{0xfedcba9876543210, "fedcba9876543210"},
+	{1<<64 - 1, "ffffffffffffffff"},
+}
+
+func TestFormatId(t *testing.T) {
+	for _, tt := range formatIdTests {
+		if got := formatId(tt.id); got != tt.want {
+			t.Errorf("formatId(%#x) = %q; want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+var normalizeIdTests = []struct {
+	id    string
+	width int
+	want  string
+}{
+	{"", 16, ""},
+	{"1", 16, "0000000000000001"},
+	{"ABCdef", 16, "0000000000abcdef"},
+	{"fedcba9876543210", 16, "fedcba9876543210"},
+	{"0fedcba9876543210", 16, ""},
+	{"0000", 16, ""},
+	{"12g4", 16, ""},
+	{"-1", 16, ""},
+	{"abc", 32, "00000000000000000000000000000abc"},
+	{"463ac35c9f6413ad48485a3953bb6124", 32, "463ac35c9f6413ad48485a3953bb6124"},
+}
+
+func TestNormalizeId(t *testing.T) {
+	for _, tt := range normalizeIdTests {
+		if got := normalizeId(tt.id, tt.width); got != tt.want {
+			t.Errorf("normalizeId(%q, %d) = %q; want %q", tt.id, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTraceId(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"abc", "0000000000000abc"},
+		{"48485a3953bb6124", "48485a3953bb6124"},
+		{"148485a3953bb6124", "000000000000000148485a3953bb6124"},
+		{"463ac35c9f6413ad48485a3953bb61240", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeTraceId(tt.id); got != tt.want {
+			t.Errorf("normalizeTraceId(%q) = %q; want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestParseTraceIdHex(t *testing.T) {
+	tests := []struct {
+		id        string
+		high, low uint64
+	}{
+		{"48485a3953bb6124", 0, 0x48485a3953bb6124},
+		{"463ac35c9f6413ad48485a3953bb6124", 0x463ac35c9f6413ad, 0x48485a3953bb6124},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		high, low := parseTraceIdHex(tt.id)
+		if high != tt.high || low != tt.low {
+			t.Errorf("parseTraceIdHex(%q) = %#x, %#x; want %#x, %#x", tt.id, high, low, tt.high, tt.low)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package http
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxGoroutineLeaks = 1000 // GoroutineLeaks 最多保留的条数
+)
+
+// GoroutineLeak 请求结束 threshold 之后还活着的协程
+type GoroutineLeak struct {
+	TraceId  string
+	SpanId   string // server span, 没采样的请求是上游传来的 span id
+	Url      string
+	Gid      int64
+	Func     string        // 协程入口函数
+	Name     string        // runtime.SetGoroutineName 设置的名字
+	Age      time.Duration // 协程创建到现在
+	Finished time.Duration // 请求结束到现在
+	Stack    string
+}
+
+// 结束了的请求, 等 threshold 之后再看它的协程. 没采样的请求也记, 没有 span 只留 id 和 url
+type finishedRequest struct {
+	traceId    string
+	spanId     string
+	url        string
+	goroutines []runtime.GpInfo // 请求处理期间创建的协程
+	end        int64            // runtime.Nanotime
+}
+
+// atomic, 没采样的请求每次都要看, 不用 leakDetector 的锁
+var leakDetectorOn int32
+
+var leakDetector struct {
+	threshold time.Duration
+	callback  func(leak GoroutineLeak)
+	finished  []finishedRequest
+	leaks     []GoroutineLeak
+	running   bool
+	sync.Mutex
+}
+
+// SetLeakDetector 打开协程泄漏检测, 请求结束 threshold 之后,
+// 请求处理期间创建的协程还活着的都当作泄漏, 交给 callback 并保留在 GoroutineLeaks 里.
+// 没采样的请求也检测, 打开后每个请求多一次 runtime.ResetgPeak, 请求结束时多拷贝一次请求的协程记录.
+// threshold <= 0 关闭检测, callback 可以为 nil
+func SetLeakDetector(threshold time.Duration, callback func(leak GoroutineLeak)) {
+	leakDetector.Lock()
+	defer leakDetector.Unlock()
+	leakDetector.threshold = threshold
+	leakDetector.callback = callback
+	if threshold <= 0 {
+		atomic.StoreInt32(&leakDetectorOn, 0)
+		leakDetector.finished = nil
+		return
+	}
+	atomic.StoreInt32(&leakDetectorOn, 1)
+	if !leakDetector.running {
+		leakDetector.running = true
+		go runLeakDetector()
+	}
+}
+
+// GoroutineLeaks 返回最近检测到的泄漏协程
+func GoroutineLeaks() []GoroutineLeak {
+	leakDetector.Lock()
+	defer leakDetector.Unlock()
+	return append([]GoroutineLeak(nil), leakDetector.leaks...)
+}
+
+//
+func leakDetectorEnabled() bool {
+	return atomic.LoadInt32(&leakDetectorOn) != 0
+}
+
+// 请求结束时记录下来, 只留还在运行的协程, 都退出了的不调 url
+func addFinishedRequest(traceId, spanId string, url func() string, goroutines []runtime.GpInfo) {
+	running := []runtime.GpInfo{}
+	for _, info := range goroutines {
+		if info.ExitNano == 0 {
+			running = append(running, info)
+		}
+	}
+	if len(running) == 0 {
+		return
+	}
+	f := finishedRequest{
+		traceId:    traceId,
+		spanId:     spanId,
+		url:        url(),
+		goroutines: running,
+		end:        runtime.Nanotime(),
+	}
+	leakDetector.Lock()
+	if leakDetector.threshold > 0 {
+		leakDetector.finished = append(leakDetector.finished, f)
+	}
+	leakDetector.Unlock()
+}
+
+// server span 结束
+func addFinishedSpan(span *traceSpan, goroutines []runtime.GpInfo) {
+	addFinishedRequest(span.TraceId, span.SpanId, func() string {
+		return span.getBinAnnotation("http.url")
+	}, goroutines)
+}
+
+// 没采样的请求结束, gid 是处理请求的协程
+func addFinishedUnsampled(req *Request, gid int64) {
+	traceId, spanId, _ := TraceIdsFromContext(req.Context())
+	addFinishedRequest(traceId, spanId, func() string {
+		return "http://" + req.Host + redactUrl(req.URL)
+	}, getRequestGoroutines(gid))
+}
+
+//
+func runLeakDetector() {
+	for {
+		leakDetector.Lock()
+		threshold := leakDetector.threshold
+		leakDetector.Unlock()
+
+		if threshold <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		if threshold < time.Second {
+			time.Sleep(threshold)
+		} else {
+			time.Sleep(threshold / 2)
+		}
+		scanGoroutineLeaks(runtime.Nanotime())
+	}
+}
+
+// 找出结束超过 threshold 的请求, 看它们的协程还在不在
+func scanGoroutineLeaks(now int64) {
+	leakDetector.Lock()
+	threshold := int64(leakDetector.threshold)
+	callback := leakDetector.callback
+	expired := []finishedRequest{}
+	i := 0
+	for ; i < len(leakDetector.finished); i++ {
+		if now-leakDetector.finished[i].end < threshold {
+			break
+		}
+		expired = append(expired, leakDetector.finished[i])
+	}
+	leakDetector.finished = leakDetector.finished[i:]
+	leakDetector.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	var stacks map[int64]string
+	leaks := []GoroutineLeak{}
+	for _, f := range expired {
+		for _, info := range f.goroutines {
+			if cur, ok := getGpInfo(info.Gid); !ok || cur.ExitNano > 0 {
+				continue
+			}
+			if stacks == nil {
+				stacks = map[int64]string{}
+				rangeGoroutineStacks(allGoroutineStacks(), func(gid int64, stack []byte) {
+					stacks[gid] = string(stack)
+				})
+			}
+			stack, ok := stacks[info.Gid]
+			if !ok { // 拿到记录之后退出了
+				continue
+			}
+			leaks = append(leaks, GoroutineLeak{
+				TraceId:  f.traceId,
+				SpanId:   f.spanId,
+				Url:      f.url,
+				Gid:      info.Gid,
+				Func:     goroutineFuncName(info),
+				Name:     info.Name,
+				Age:      time.Duration(now - info.Nano),
+				Finished: time.Duration(now - f.end),
+				Stack:    stack,
+			})
+		}
+	}
+	if len(leaks) == 0 {
+		return
+	}
+
+	leakDetector.Lock()
+	leakDetector.leaks = append(leakDetector.leaks, leaks...)
+	if n := len(leakDetector.leaks); n > maxGoroutineLeaks {
+		leakDetector.leaks = append([]GoroutineLeak(nil), leakDetector.leaks[n-maxGoroutineLeaks:]...)
+	}
+	leakDetector.Unlock()
+
+	if callback != nil {
+		for _, leak := range leaks {
+			callback(leak)
+		}
+	}
+}
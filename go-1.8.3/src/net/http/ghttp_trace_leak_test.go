@@ -0,0 +1,121 @@
+package http
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 泄漏的协程, 栈里能看到这个函数
+func testLeakedGoroutine(gid chan<- int64, block <-chan struct{}) {
+	buf := make([]byte, 64)
+	gid <- parseGoroutineId(buf[:runtime.Stack(buf, false)])
+	<-block
+}
+
+func TestScanGoroutineLeaks(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	gidc := make(chan int64)
+	go testLeakedGoroutine(gidc, block)
+	leaked := <-gidc
+
+	fake := &fakeGpInfos{infos: map[int64]runtime.GpInfo{}}
+	getGpInfo = fake.get
+	defer func() { getGpInfo = runtime.GetGpInfo }()
+
+	// threshold 1 小时, 后台的 runLeakDetector 测试期间不会扫
+	var got []GoroutineLeak
+	SetLeakDetector(time.Hour, func(leak GoroutineLeak) { got = append(got, leak) })
+	defer SetLeakDetector(0, nil)
+	leakDetector.Lock()
+	leakDetector.leaks = nil
+	leakDetector.Unlock()
+	if !leakDetectorEnabled() {
+		t.Fatal("leak detector not enabled")
+	}
+
+	now := runtime.Nanotime()
+	pc := funcPC(func() { testLeakedGoroutine(nil, nil) })
+	running := runtime.GpInfo{Gid: leaked, Nano: now, StartPC: pc, Name: "leaker"}
+	exitedLater := runtime.GpInfo{Gid: leaked + 1e9, Nano: now}
+	fake.set(running)
+	fake.set(runtime.GpInfo{Gid: exitedLater.Gid, Nano: now, ExitNano: now + 1})
+
+	span := newSampledSpan("GET")
+	span.addBinAnnotation(&endpoint{}, "http.url", "http://example.com/leak")
+	addFinishedSpan(span, []runtime.GpInfo{
+		running,
+		exitedLater,
+		{Gid: leaked + 2e9, Nano: now, ExitNano: now + 1}, // 请求结束前就退出了, 不记
+	})
+	// 都退出了的请求不记, 也不拼 url
+	addFinishedRequest("t", "s", func() string {
+		t.Error("url called for a request without running goroutines")
+		return ""
+	}, []runtime.GpInfo{{Gid: leaked + 3e9, ExitNano: now}})
+
+	scanGoroutineLeaks(runtime.Nanotime())
+	if len(got) != 0 || len(GoroutineLeaks()) != 0 {
+		t.Fatalf("leaks reported before threshold: %+v", got)
+	}
+
+	scanGoroutineLeaks(runtime.Nanotime() + int64(2*time.Hour))
+	if len(got) != 1 {
+		t.Fatalf("got %d leaks; want 1: %+v", len(got), got)
+	}
+	leak := got[0]
+	if leak.Gid != leaked || leak.TraceId != span.TraceId || leak.SpanId != span.SpanId ||
+		leak.Url != "http://example.com/leak" || leak.Name != "leaker" {
+		t.Errorf("leak = %+v; want gid %d, trace %s, span %s, url http://example.com/leak, name leaker",
+			leak, leaked, span.TraceId, span.SpanId)
+	}
+	if leak.Func != runtime.FuncForPC(pc).Name() {
+		t.Errorf("leak.Func = %q; want %q", leak.Func, runtime.FuncForPC(pc).Name())
+	}
+	if !strings.Contains(leak.Stack, "testLeakedGoroutine") {
+		t.Errorf("leak.Stack does not contain testLeakedGoroutine:\n%s", leak.Stack)
+	}
+	if leak.Finished < 2*time.Hour || leak.Age < 2*time.Hour {
+		t.Errorf("leak.Finished = %v, leak.Age = %v; want >= 2h", leak.Finished, leak.Age)
+	}
+	if leaks := GoroutineLeaks(); len(leaks) != 1 || leaks[0].Gid != leaked {
+		t.Errorf("GoroutineLeaks() = %+v; want the leak of goroutine %d", leaks, leaked)
+	}
+
+	// 扫过的请求不再扫
+	scanGoroutineLeaks(runtime.Nanotime() + int64(3*time.Hour))
+	if len(got) != 1 {
+		t.Errorf("got %d leaks after rescan; want 1", len(got))
+	}
+}
+
+func TestSetLeakDetectorOff(t *testing.T) {
+	SetLeakDetector(time.Hour, nil)
+	addFinishedRequest("t", "s", func() string { return "" }, []runtime.GpInfo{{Gid: 1}})
+	leakDetector.Lock()
+	n := len(leakDetector.finished)
+	leakDetector.Unlock()
+	if n == 0 {
+		t.Fatal("finished request not recorded")
+	}
+
+	SetLeakDetector(0, nil)
+	if leakDetectorEnabled() {
+		t.Error("leak detector enabled after SetLeakDetector(0)")
+	}
+	leakDetector.Lock()
+	n = len(leakDetector.finished)
+	leakDetector.Unlock()
+	if n != 0 {
+		t.Errorf("%d finished requests kept after SetLeakDetector(0)", n)
+	}
+	addFinishedRequest("t", "s", func() string { return "" }, []runtime.GpInfo{{Gid: 1}})
+	leakDetector.Lock()
+	n = len(leakDetector.finished)
+	leakDetector.Unlock()
+	if n != 0 {
+		t.Errorf("finished request recorded with the detector off")
+	}
+}
@@ -0,0 +1,157 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sync"
+)
+
+var (
+	logCaptureMaxLen   = 0 // 每行 log 最多记多少字节
+	logCaptureMaxLines = 0 // 每个 span 最多记多少行 log, 0 不记
+	logTracePrefix     = false
+	logTraceMu         sync.Mutex // SetLogTrace 和 SetSpanLogCapture 一起决定装不装 log 的 hook
+)
+
+// SetSpanLogCapture 打开后, log 包的 log 和经过 TraceLogWriter 的 log 也作为带时间的 annotation
+// ("log: ...") 记到当前协程的 span 上, 每行最多 maxLen 字节, 每个 span 最多 maxLines 行,
+// maxLines <= 0 关闭. 不用另外 SetLogTrace, 没有 SetLogTrace 时 log 不加 trace 前缀
+func SetSpanLogCapture(maxLen, maxLines int) {
+	logTraceMu.Lock()
+	defer logTraceMu.Unlock()
+	logCaptureMaxLen = maxLen
+	logCaptureMaxLines = maxLines
+	updateLogHook()
+}
+
+// CurrentTraceIds 返回当前协程所在 span 的 trace id, span id 和是否采样,
+// 不在 trace 里 traceId 为 ""
+func CurrentTraceIds() (traceId, spanId string, sampled bool) {
+	return entryTraceIds(getCurTrace())
+}
+
+// TraceIdsFromContext 和 CurrentTraceIds 一样, 先从 ctx 里找 span
+func TraceIdsFromContext(ctx context.Context) (traceId, spanId string, sampled bool) {
+	if span := getSpanFromContext(ctx); span != nil {
+		return traceIds(span)
+	}
+	if u := getUnsampledFromContext(ctx); u != nil {
+		return entryTraceIds(spanEntry{unsampled: u})
+	}
+	return CurrentTraceIds()
+}
+
+// 没采样的请求也有 trace 信息
+func entryTraceIds(e spanEntry) (traceId, spanId string, sampled bool) {
+	if u := e.unsampled; u != nil && enableHttpTrace {
+		traceId, spanId = u.ids()
+		return traceId, spanId, false
+	}
+	return traceIds(e.span)
+}
+
+//
+func traceIds(span *traceSpan) (traceId, spanId string, sampled bool) {
+	if span == nil || !enableHttpTrace {
+		return "", "", false
+	}
+	return span.TraceId, span.SpanId, span.isSample
+}
+
+// SetLogTrace 打开后, log 包所有 Logger 的每一行在日期, 文件名这些 header 后面加上当前协程的
+// "trace=<id> span=<id> ", 不在 trace 里的不加. 用的是 log.SetLineHook, 不用换 Logger 的 Writer
+func SetLogTrace(enable bool) {
+	logTraceMu.Lock()
+	defer logTraceMu.Unlock()
+	logTracePrefix = enable
+	updateLogHook()
+}
+
+// 加前缀和记 log 都不要时不装 hook, log 包不多找一次 span. 调用时持有 logTraceMu
+func updateLogHook() {
+	switch {
+	case logTracePrefix:
+		log.SetLineHook(logTraceHook)
+	case logCaptureMaxLines > 0:
+		log.SetLineHook(logCaptureHook)
+	default:
+		log.SetLineHook(nil)
+	}
+}
+
+//
+func logTraceHook(s string) string {
+	cur := getCurTrace()
+	traceId, spanId, _ := entryTraceIds(cur)
+	if traceId == "" {
+		return ""
+	}
+	if logCaptureMaxLines > 0 && cur.span != nil {
+		addLogAnnotation(cur.span, []byte(s))
+	}
+	return "trace=" + traceId + " span=" + spanId + " "
+}
+
+// 只记 log 不加前缀
+func logCaptureHook(s string) string {
+	if span := getCurSpan(); span != nil && enableHttpTrace {
+		addLogAnnotation(span, []byte(s))
+	}
+	return ""
+}
+
+// TraceLogWriter 包装 w, 每次 Write 前面加上当前协程的 "trace=<id> span=<id> ",
+// 给不是 log 包的 Writer 用, log 包用 SetLogTrace. log.SetOutput(http.TraceLogWriter(os.Stderr))
+// 也可以, 只是前缀在日期前面. log.Logger 在调用 Printf 的协程上一次 Write 一行, 所以能找到调用者的 span
+func TraceLogWriter(w io.Writer) io.Writer {
+	return &traceLogWriter{w: w}
+}
+
+//
+type traceLogWriter struct {
+	w io.Writer
+}
+
+//
+func (l *traceLogWriter) Write(p []byte) (int, error) {
+	cur := getCurTrace()
+	traceId, spanId, _ := entryTraceIds(cur)
+	if traceId == "" {
+		return l.w.Write(p)
+	}
+	if logCaptureMaxLines > 0 && cur.span != nil {
+		addLogAnnotation(cur.span, p)
+	}
+
+	b := make([]byte, 0, len(p)+len(traceId)+len(spanId)+13)
+	b = append(b, "trace="...)
+	b = append(b, traceId...)
+	b = append(b, " span="...)
+	b = append(b, spanId...)
+	b = append(b, ' ')
+	b = append(b, p...)
+	if _, err := l.w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 把一行 log 记到 span 上, 超过 logCaptureMaxLines 的丢掉
+func addLogAnnotation(span *traceSpan, line []byte) {
+	span.Lock()
+	if span.logLines >= logCaptureMaxLines {
+		span.Unlock()
+		return
+	}
+	span.logLines++
+	span.Unlock()
+
+	line = bytes.TrimRight(line, "\n")
+	if logCaptureMaxLen > 0 && len(line) > logCaptureMaxLen {
+		line = append(line[:logCaptureMaxLen:logCaptureMaxLen], "..."...)
+	}
+	ep := &endpoint{Ipv4: localIpv4, ServiceName: execName, Port: span.localPort}
+	span.addAnnotation(ep, getTraceTime(), "log: "+string(line))
+}
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestTraceLogWriter(t *testing.T) {
+	span := newTraceSpan()
+	span.TraceId = "00000000000000a1"
+	span.SpanId = "00000000000000b2"
+	span.isSample = true
+
+	tests := []struct {
+		name  string
+		entry spanEntry
+		want  string
+	}{
+		{"no trace", spanEntry{}, "hello\n"},
+		{"sampled", spanEntry{span: span}, "trace=00000000000000a1 span=00000000000000b2 hello\n"},
+		{"unsampled", spanEntry{unsampled: &unsampledTrace{traceId: "00000000000000c3", spanId: "00000000000000d4"}},
+			"trace=00000000000000c3 span=00000000000000d4 hello\n"},
+	}
+
+	gid := runtime.Getgid()
+	prev := spanTable.getEntry(gid)
+	defer spanTable.setEntry(gid, prev)
+	for _, tt := range tests {
+		spanTable.setEntry(gid, tt.entry)
+		var buf bytes.Buffer
+		n, err := TraceLogWriter(&buf).Write([]byte("hello\n"))
+		if n != len("hello\n") || err != nil {
+			t.Errorf("%s: Write = %d, %v; want %d, nil", tt.name, n, err, len("hello\n"))
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: wrote %q; want %q", tt.name, got, tt.want)
+		}
+		if got, want := logTraceHook("hello"), tt.want[:len(tt.want)-len("hello\n")]; got != want {
+			t.Errorf("%s: logTraceHook = %q; want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestTraceLogWriterCapture(t *testing.T) {
+	SetSpanLogCapture(5, 2)
+	defer SetSpanLogCapture(0, 0)
+
+	span := newTraceSpan()
+	span.TraceId = "00000000000000a1"
+	span.SpanId = "00000000000000b2"
+
+	gid := runtime.Getgid()
+	prev := spanTable.addSpan(gid, span)
+	defer spanTable.setEntry(gid, prev)
+
+	w := TraceLogWriter(new(bytes.Buffer))
+	for _, line := range []string{"one\n", "second line\n", "third\n"} {
+		w.Write([]byte(line))
+	}
+
+	var got []string
+	for _, a := range span.Annotation {
+		got = append(got, a.Value)
+	}
+	want := []string{"log: one", "log: secon..."}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("annotations = %q; want %q", got, want)
+	}
+}
+
+// log.Printf 经过 SetLogTrace/SetSpanLogCapture 装的 hook
+func TestLogPrintfTrace(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLogTrace(false)
+		SetSpanLogCapture(0, 0)
+	}()
+
+	span := newTraceSpan()
+	span.TraceId = "00000000000000a1"
+	span.SpanId = "00000000000000b2"
+	gid := runtime.Getgid()
+	prev := spanTable.addSpan(gid, span)
+	defer spanTable.setEntry(gid, prev)
+
+	logs := func() []string {
+		span.Lock()
+		defer span.Unlock()
+		var ret []string
+		for _, a := range span.Annotation {
+			ret = append(ret, a.Value)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name     string
+		trace    bool
+		maxLines int
+		want     string
+		captured int // 这之后 span 上一共有几行 log
+	}{
+		{"off", false, 0, "hello 1\n", 0},
+		{"capture only", false, 10, "hello 2\n", 1},
+		{"trace only", true, 0, "trace=00000000000000a1 span=00000000000000b2 hello 3\n", 1},
+		{"trace and capture", true, 10, "trace=00000000000000a1 span=00000000000000b2 hello 4\n", 2},
+		{"off again", false, 0, "hello 5\n", 2},
+	}
+	for i, tt := range tests {
+		SetLogTrace(tt.trace)
+		SetSpanLogCapture(0, tt.maxLines)
+		buf.Reset()
+		log.Printf("hello %d", i+1)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: log %q; want %q", tt.name, got, tt.want)
+		}
+		if got := logs(); len(got) != tt.captured {
+			t.Errorf("%s: span logs %q; want %d lines", tt.name, got, tt.captured)
+		}
+	}
+	if got := logs(); len(got) != 2 || got[0] != "log: hello 2" || got[1] != "log: hello 4" {
+		t.Errorf("span logs = %q; want [log: hello 2, log: hello 4]", got)
+	}
+}
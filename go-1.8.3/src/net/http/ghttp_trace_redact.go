@@ -0,0 +1,164 @@
+package http
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue = "redacted"
+)
+
+// UrlRedaction 是记录 http.url 之前的脱敏规则, 零值去掉 url 里的用户名密码,
+// 并把 DefaultDenyQuery 里的 query 参数值替换成 "redacted"
+type UrlRedaction struct {
+	AllowQuery   []string   // 不为空时, 不在里面的 query 参数值都替换成 "redacted"
+	DenyQuery    []string   // 这些 query 参数的值替换成 "redacted", 不区分大小写. nil 用 DefaultDenyQuery, 空的 slice 不替换
+	PathRules    []PathRule // 按顺序匹配路径的每一段, 用第一个匹配的规则替换
+	KeepUserinfo bool       // 保留 url 里的用户名密码
+}
+
+// PathRule 路径里整段匹配 Pattern 的换成 Replace, 比如数字 id 换成 ":id"
+type PathRule struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// DefaultDenyQuery 是 DenyQuery 为 nil 时脱敏的 query 参数, 常见的 token, 密码和 key
+var DefaultDenyQuery = []string{
+	"token", "access_token", "refresh_token", "id_token",
+	"password", "passwd", "pwd", "secret", "client_secret",
+	"api_key", "apikey", "key", "signature", "sig", "session", "sessionid",
+}
+
+var (
+	urlRedactionMu sync.Mutex
+	urlRedaction   = &UrlRedaction{}
+)
+
+// SetUrlRedaction 设置 server span 和 client span 里 http.url 的脱敏规则, nil 恢复默认
+func SetUrlRedaction(r *UrlRedaction) {
+	if r == nil {
+		r = &UrlRedaction{}
+	}
+	urlRedactionMu.Lock()
+	urlRedaction = r
+	urlRedactionMu.Unlock()
+}
+
+// 按当前的规则脱敏, Client.Do 检查 req.URL 之前就会调用, u 可能为 nil
+func redactUrl(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	urlRedactionMu.Lock()
+	r := urlRedaction
+	urlRedactionMu.Unlock()
+	return r.redact(u)
+}
+
+//
+func (r *UrlRedaction) redact(u *url.URL) string {
+	u2 := *u
+	if !r.KeepUserinfo {
+		u2.User = nil
+	}
+
+	if len(r.PathRules) > 0 && u2.Path != "" {
+		// 按转义后的路径分段, 段里的 %2F 不算分隔符
+		segs := strings.Split(u2.EscapedPath(), "/")
+		paths := make([]string, len(segs))
+		for i, seg := range segs {
+			p, err := url.PathUnescape(seg)
+			if err != nil {
+				p = seg
+			}
+			paths[i] = p
+			if p == "" {
+				continue
+			}
+			for _, rule := range r.PathRules {
+				if rule.Pattern.MatchString(p) {
+					segs[i], paths[i] = rule.Replace, rule.Replace
+					break
+				}
+			}
+		}
+		u2.Path = strings.Join(paths, "/")
+		u2.RawPath = strings.Join(segs, "/")
+	}
+
+	deny := r.DenyQuery
+	if deny == nil {
+		deny = DefaultDenyQuery
+	}
+	if (len(r.AllowQuery) > 0 || len(deny) > 0) && u2.RawQuery != "" {
+		q := u2.Query()
+		for k, vs := range q {
+			if r.redactQuery(deny, k) {
+				for i := range vs {
+					vs[i] = redactedValue
+				}
+			}
+		}
+		u2.RawQuery = q.Encode()
+	}
+	return u2.String()
+}
+
+//
+func (r *UrlRedaction) redactQuery(deny []string, key string) bool {
+	for _, k := range deny {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	if len(r.AllowQuery) == 0 {
+		return false
+	}
+	for _, k := range r.AllowQuery {
+		if k == key {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------------------------------------------------------------------------
+// 头的脱敏
+
+var (
+	headerRedactionMu sync.Mutex
+	// SetSpanHeaders 配了这些头也只记 "redacted"
+	redactHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+	defaultRedactHeaders = redactHeaders
+)
+
+// SetHeaderRedaction 设置记录到 span 上时值换成 "redacted" 的头, 对 SetSpanHeaders 配的头生效.
+// nil 恢复默认 (Authorization, Proxy-Authorization, Cookie, Set-Cookie), 空的 slice 不脱敏
+func SetHeaderRedaction(names []string) {
+	m := defaultRedactHeaders
+	if names != nil {
+		m = map[string]bool{}
+		for _, name := range names {
+			m[CanonicalHeaderKey(name)] = true
+		}
+	}
+	headerRedactionMu.Lock()
+	redactHeaders = m
+	headerRedactionMu.Unlock()
+}
+
+// name 是规范化之后的头
+func redactHeader(name string) bool {
+	headerRedactionMu.Lock()
+	defer headerRedactionMu.Unlock()
+	return redactHeaders[name]
+}
@@ -0,0 +1,186 @@
+package http
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SpanReporter 接收一批记录好的 span, batch 是 zipkin v1 格式的 json 数组.
+// Report 在记录 span 的协程上依次调用, 不会并发
+type SpanReporter interface {
+	Report(batch []byte) error
+}
+
+// FileSpanReporter 把 span 追加写到 Dir 下的 trace_<日期>_<pid>.txt, 是默认的 SpanReporter
+type FileSpanReporter struct {
+	Dir string // 空表示当前目录
+}
+
+// Report 实现 SpanReporter
+func (r *FileSpanReporter) Report(batch []byte) error {
+	name := fmt.Sprintf("trace_%s_%d.txt", time.Now().Format("2006-01-02"), os.Getpid())
+	f, err := os.OpenFile(filepath.Join(r.Dir, name), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(batch)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var (
+	spanReporterMu sync.Mutex
+	spanReporter   SpanReporter = &FileSpanReporter{Dir: "."}
+)
+
+// SetSpanReporter 替换记录 span 的 SpanReporter, nil 恢复成默认的 FileSpanReporter
+func SetSpanReporter(r SpanReporter) {
+	if r == nil {
+		r = &FileSpanReporter{Dir: "."}
+	}
+	spanReporterMu.Lock()
+	spanReporter = r
+	spanReporterMu.Unlock()
+}
+
+//
+func getSpanReporter() SpanReporter {
+	spanReporterMu.Lock()
+	defer spanReporterMu.Unlock()
+	return spanReporter
+}
+
+// ------------------------------------------------------------------------------------
+// 交给 SpanReporter 之前的处理
+
+// SpanProcessor 在记录 span 的协程上依次调用, 可以改 span, 返回 false 丢掉这个 span
+type SpanProcessor func(r *SpanRecord) bool
+
+var (
+	spanProcessorsMu sync.Mutex
+	spanProcessors   []SpanProcessor
+)
+
+// AddSpanProcessor 加一个 SpanProcessor, 按加入的顺序执行, 比如丢掉健康检查,
+// 加上部署环境的 tag, 改名字或者脱敏
+func AddSpanProcessor(p SpanProcessor) {
+	spanProcessorsMu.Lock()
+	spanProcessors = append(spanProcessors, p)
+	spanProcessorsMu.Unlock()
+}
+
+// 返回 false 表示 span 被丢掉了
+func processSpan(span *traceSpan) bool {
+	spanProcessorsMu.Lock()
+	processors := spanProcessors
+	spanProcessorsMu.Unlock()
+
+	if len(processors) == 0 {
+		return true
+	}
+	r := &SpanRecord{span: span}
+	for _, p := range processors {
+		if !p(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// SpanRecord 是交给 SpanProcessor 的 span, 只在 SpanProcessor 调用期间有效
+type SpanRecord struct {
+	span *traceSpan
+}
+
+// TraceId 返回 trace id
+func (r *SpanRecord) TraceId() string {
+	return r.span.TraceId
+}
+
+// SpanId 返回 span id
+func (r *SpanRecord) SpanId() string {
+	return r.span.SpanId
+}
+
+// ParentId 返回父 span id, 根 span 为 ""
+func (r *SpanRecord) ParentId() string {
+	return r.span.ParentId
+}
+
+// IsServer 是不是接收请求的 server span
+func (r *SpanRecord) IsServer() bool {
+	return r.span.isRecvReq
+}
+
+// IsRoot 这个 span 是不是开始了一个新的 trace, 比如收到没有 trace 信息的请求
+func (r *SpanRecord) IsRoot() bool {
+	return r.span.isRoot
+}
+
+// Name 返回 span 的名字
+func (r *SpanRecord) Name() string {
+	return r.span.Name
+}
+
+// SetName 改 span 的名字
+func (r *SpanRecord) SetName(name string) {
+	r.span.Name = name
+}
+
+// Duration 返回 span 的耗时
+func (r *SpanRecord) Duration() time.Duration {
+	return time.Duration(r.span.Duration) * time.Microsecond
+}
+
+// Tag 返回 key 对应的 binary annotation
+func (r *SpanRecord) Tag(key string) (value string, ok bool) {
+	r.span.Lock()
+	defer r.span.Unlock()
+	for _, a := range r.span.BinAnnotation {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetTag 设置 key 对应的 binary annotation, 没有就加一个
+func (r *SpanRecord) SetTag(key, value string) {
+	r.span.Lock()
+	defer r.span.Unlock()
+	for i := range r.span.BinAnnotation {
+		if r.span.BinAnnotation[i].Key == key {
+			r.span.BinAnnotation[i].Value = value
+			return
+		}
+	}
+	ep := endpoint{Ipv4: localIpv4, ServiceName: execName, Port: r.span.localPort}
+	r.span.BinAnnotation = append(r.span.BinAnnotation, binAnnotation{Endpoint: ep, Key: key, Value: value})
+}
+
+// RewriteTags 用 fun 的返回值替换每个 binary annotation 的值
+func (r *SpanRecord) RewriteTags(fun func(key, value string) string) {
+	r.span.Lock()
+	defer r.span.Unlock()
+	for i, a := range r.span.BinAnnotation {
+		r.span.BinAnnotation[i].Value = fun(a.Key, a.Value)
+	}
+}
+
+// RewriteAnnotations 用 fun 的返回值替换每个带时间的 annotation 的值, sr/ss/cs/cr 不会传给 fun
+func (r *SpanRecord) RewriteAnnotations(fun func(value string) string) {
+	r.span.Lock()
+	defer r.span.Unlock()
+	for i, a := range r.span.Annotation {
+		switch a.Value {
+		case "sr", "ss", "cs", "cr":
+			continue
+		}
+		r.span.Annotation[i].Value = fun(a.Value)
+	}
+}
@@ -0,0 +1,197 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 记下每次 Report 的 batch, err 不为 nil 时返回 err
+type recordSpanReporter struct {
+	batches [][]byte
+	err     error
+}
+
+func (r *recordSpanReporter) Report(batch []byte) error {
+	r.batches = append(r.batches, append([]byte(nil), batch...))
+	return r.err
+}
+
+func TestSetSpanReporter(t *testing.T) {
+	defer SetSpanReporter(nil)
+	r := &recordSpanReporter{}
+	SetSpanReporter(r)
+	if getSpanReporter() != r {
+		t.Fatal("SetSpanReporter did not replace the reporter")
+	}
+
+	a, b := newSampledSpan("a"), newSampledSpan("b")
+	reportSpans([]*traceSpan{a, b})
+	if len(r.batches) != 1 {
+		t.Fatalf("Report called %d times; want 1", len(r.batches))
+	}
+	var got []struct {
+		TraceId string `json:"traceId"`
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+	}
+	if err := json.Unmarshal(r.batches[0], &got); err != nil {
+		t.Fatalf("batch is not a json array: %v\n%s", err, r.batches[0])
+	}
+	if len(got) != 2 || got[0].Name != "a" || got[0].Id != a.SpanId || got[1].TraceId != b.TraceId {
+		t.Errorf("batch = %+v; want spans a and b", got)
+	}
+
+	// Report 出错打 log
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	r.err = errors.New("disk full")
+	reportSpans([]*traceSpan{a})
+	if !strings.Contains(buf.String(), "http: trace report error: disk full") {
+		t.Errorf("log = %q; want the report error", buf.String())
+	}
+
+	SetSpanReporter(nil)
+	if f, ok := getSpanReporter().(*FileSpanReporter); !ok || f.Dir != "." {
+		t.Errorf("reporter after SetSpanReporter(nil) = %#v; want FileSpanReporter in .", getSpanReporter())
+	}
+}
+
+func TestFileSpanReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &FileSpanReporter{Dir: dir}
+	for _, batch := range []string{`[{"id":"1"}]`, `[{"id":"2"}]`} {
+		if err := r.Report([]byte(batch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, fmt.Sprintf("trace_%s_%d.txt", time.Now().Format("2006-01-02"), os.Getpid()))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[{"id":"1"}][{"id":"2"}]`; got != want {
+		t.Errorf("%s = %q; want %q", name, got, want)
+	}
+
+	r.Dir = filepath.Join(dir, "missing")
+	if err := r.Report([]byte("[]")); err == nil {
+		t.Error("Report into a missing directory succeeded")
+	}
+}
+
+// 测试期间只用 processors, 结束时恢复
+func setSpanProcessors(processors ...SpanProcessor) (restore func()) {
+	spanProcessorsMu.Lock()
+	saved := spanProcessors
+	spanProcessors = nil
+	spanProcessorsMu.Unlock()
+	for _, p := range processors {
+		AddSpanProcessor(p)
+	}
+	return func() {
+		spanProcessorsMu.Lock()
+		spanProcessors = saved
+		spanProcessorsMu.Unlock()
+	}
+}
+
+func TestSpanProcessorOrder(t *testing.T) {
+	var calls []string
+	record := func(name string, keep bool) SpanProcessor {
+		return func(r *SpanRecord) bool {
+			calls = append(calls, name)
+			return keep || r.Name() != "health"
+		}
+	}
+	defer setSpanProcessors(record("first", true), record("drop", false), record("last", true))()
+
+	if !processSpan(newSampledSpan("GET")) {
+		t.Error("span dropped")
+	}
+	if got := strings.Join(calls, ","); got != "first,drop,last" {
+		t.Errorf("processors ran %s; want first,drop,last", got)
+	}
+	calls = nil
+	if processSpan(newSampledSpan("health")) {
+		t.Error("health span not dropped")
+	}
+	if got := strings.Join(calls, ","); got != "first,drop" {
+		t.Errorf("processors ran %s; want first,drop", got)
+	}
+}
+
+func TestSpanProcessorRewrite(t *testing.T) {
+	span := newSampledSpan("GET")
+	ep := &endpoint{ServiceName: "svc"}
+	span.addAnnotation(ep, 1, "sr")
+	span.addAnnotation(ep, 2, "log: password=123")
+	span.addAnnotation(ep, 3, "ss")
+	span.addBinAnnotation(ep, "http.url", "http://a/b?token=x")
+	span.addBinAnnotation(ep, "http.method", "GET")
+
+	defer setSpanProcessors(
+		func(r *SpanRecord) bool {
+			r.SetName("GET /b")
+			r.SetTag("env", "prod")        // 加
+			r.SetTag("http.method", "get") // 改
+			return true
+		},
+		func(r *SpanRecord) bool {
+			// 后面的 processor 看到前面改过的
+			if r.Name() != "GET /b" {
+				t.Errorf("second processor sees name %q; want GET /b", r.Name())
+			}
+			if v, ok := r.Tag("env"); !ok || v != "prod" {
+				t.Errorf("second processor sees env = %q, %v; want prod", v, ok)
+			}
+			r.RewriteTags(func(key, value string) string {
+				if key == "http.url" {
+					return strings.Replace(value, "token=x", "token=***", 1)
+				}
+				return value
+			})
+			r.RewriteAnnotations(func(value string) string {
+				return strings.Replace(value, "password=123", "password=***", 1)
+			})
+			return true
+		},
+	)()
+
+	if !processSpan(span) {
+		t.Fatal("span dropped")
+	}
+	if span.Name != "GET /b" {
+		t.Errorf("name = %q; want GET /b", span.Name)
+	}
+	wantTags := map[string]string{"http.url": "http://a/b?token=***", "http.method": "get", "env": "prod"}
+	if len(span.BinAnnotation) != len(wantTags) {
+		t.Errorf("%d tags; want %d: %+v", len(span.BinAnnotation), len(wantTags), span.BinAnnotation)
+	}
+	for k, v := range wantTags {
+		if got := spanTag(span, k); got != v {
+			t.Errorf("tag %s = %q; want %q", k, got, v)
+		}
+	}
+	var got []string
+	for _, a := range span.Annotation {
+		got = append(got, a.Value)
+	}
+	if want := "sr,log: password=***,ss"; strings.Join(got, ",") != want {
+		t.Errorf("annotations = %q; want %s", got, want)
+	}
+}
@@ -0,0 +1,256 @@
+package http
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SamplePolicy 决定新开的 trace 要不要记录, 上游已经决定了的 trace 不会问它.
+// req 是开始这个 trace 的请求, StartSpan 开始的 trace 为 nil.
+// 不记录的 trace 照样往下游传 trace 信息 (X-W-Sample: false)
+type SamplePolicy interface {
+	Sample(req *Request) bool
+}
+
+// SamplePolicyFunc 把函数转成 SamplePolicy
+type SamplePolicyFunc func(req *Request) bool
+
+// Sample 实现 SamplePolicy
+func (f SamplePolicyFunc) Sample(req *Request) bool {
+	return f(req)
+}
+
+var (
+	samplePolicyMu sync.Mutex
+	samplePolicy   SamplePolicy // nil 表示全部记录
+)
+
+// SetSamplePolicy 设置新开的 trace 的采样策略, nil 表示全部记录
+func SetSamplePolicy(p SamplePolicy) {
+	samplePolicyMu.Lock()
+	samplePolicy = p
+	samplePolicyMu.Unlock()
+}
+
+// 新开的 trace 要不要记录, 先问 SamplePolicy, 再按 TraceBudget 的自适应采样率
+func sampleRoot(req *Request) bool {
+	samplePolicyMu.Lock()
+	p := samplePolicy
+	samplePolicyMu.Unlock()
+	if p != nil && !p.Sample(req) {
+		return false
+	}
+	return sampleAdaptive()
+}
+
+// 上游的 X-W-Sample, 没有返回 decided 为 false
+func parseSampleHeader(v string) (sampled, decided bool) {
+	switch strings.ToLower(v) {
+	case "true", "1":
+		return true, true
+	case "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// ProbabilitySampler 按概率 rate (0 到 1) 记录
+func ProbabilitySampler(rate float64) SamplePolicy {
+	return SamplePolicyFunc(func(req *Request) bool {
+		return rand.Float64() < rate
+	})
+}
+
+// RateLimitSampler 每秒最多记录 perSecond 个 trace
+func RateLimitSampler(perSecond int) SamplePolicy {
+	return &rateLimitSampler{perSecond: perSecond}
+}
+
+//
+type rateLimitSampler struct {
+	perSecond int
+	second    int64
+	count     int
+	sync.Mutex
+}
+
+//
+func (s *rateLimitSampler) Sample(req *Request) bool {
+	now := time.Now().Unix()
+	s.Lock()
+	defer s.Unlock()
+	if now != s.second {
+		s.second = now
+		s.count = 0
+	}
+	if s.count >= s.perSecond {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// RouteSampleRule 路径前缀是 Prefix, 方法是 Method (空表示任意) 的请求用 Policy
+type RouteSampleRule struct {
+	Prefix string
+	Method string
+	Policy SamplePolicy
+}
+
+// RouteSampler 按顺序找第一个匹配的 RouteSampleRule, 都不匹配用 def, def 为 nil 表示记录
+func RouteSampler(rules []RouteSampleRule, def SamplePolicy) SamplePolicy {
+	rules = append([]RouteSampleRule(nil), rules...)
+	return SamplePolicyFunc(func(req *Request) bool {
+		if req != nil && req.URL != nil {
+			for _, rule := range rules {
+				if rule.Method != "" && rule.Method != req.Method {
+					continue
+				}
+				if strings.HasPrefix(req.URL.Path, rule.Prefix) {
+					return rule.Policy.Sample(req)
+				}
+			}
+		}
+		if def == nil {
+			return true
+		}
+		return def.Sample(req)
+	})
+}
+
+// ------------------------------------------------------------------------------------
+// tail sampling
+
+// TailSampling 打开后, 请求里的 span 先不报告, 等 server span 结束时再决定:
+// 耗时超过 MinDuration, 或者有 error, 或者 http.status_code >= MinStatusCode,
+// 或者带 FLAG_DEBUG 的整个请求都报告, 其它的丢掉
+type TailSampling struct {
+	MinDuration   time.Duration // 0 不按耗时保留
+	MinStatusCode int           // 0 表示 500
+}
+
+var (
+	tailSamplingMu sync.Mutex
+	tailSampling   *TailSampling
+)
+
+// SetTailSampling 设置 tail sampling, nil 关闭
+func SetTailSampling(t *TailSampling) {
+	tailSamplingMu.Lock()
+	tailSampling = t
+	tailSamplingMu.Unlock()
+}
+
+//
+func getTailSampling() *TailSampling {
+	tailSamplingMu.Lock()
+	defer tailSamplingMu.Unlock()
+	return tailSampling
+}
+
+// logTrace 时调用, 返回现在要报告的 span
+func tailSampleSpans(span *traceSpan) []*traceSpan {
+	t := getTailSampling()
+	root := span.recvSpan()
+	if t == nil || root == nil {
+		return []*traceSpan{span}
+	}
+
+	// 不是 server span, 等 server span 结束时一起报告,
+	// server span 已经结束了就按它的决定来
+	if span != root {
+		root.Lock()
+		decided, keep := root.tailDecided, root.tailKeep
+		root.Unlock()
+		if decided && keep && span.markTailSent() {
+			return []*traceSpan{span}
+		}
+		return nil
+	}
+
+	keep := t.keep(root, root.finishedChildSpans(nil))
+	root.Lock()
+	root.tailDecided = true
+	root.tailKeep = keep
+	root.Unlock()
+	if !keep {
+		return nil
+	}
+
+	// 决定之前刚结束的 span 也要找到, markTailSent 保证只报告一次
+	ret := []*traceSpan{}
+	for _, s := range root.finishedChildSpans([]*traceSpan{root}) {
+		if s.markTailSent() {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// 把已经结束了的子孙 span 加到 spans 后面
+func (s *traceSpan) finishedChildSpans(spans []*traceSpan) []*traceSpan {
+	s.Lock()
+	children := append([]*traceSpan(nil), s.childSpans...)
+	s.Unlock()
+	for _, c := range children {
+		c.Lock()
+		finished := c.finished
+		c.Unlock()
+		if finished && c.isSample {
+			spans = append(spans, c)
+		}
+		spans = c.finishedChildSpans(spans)
+	}
+	return spans
+}
+
+// 返回 false 表示已经报告过了
+func (s *traceSpan) markTailSent() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.tailSent {
+		return false
+	}
+	s.tailSent = true
+	return true
+}
+
+//
+func (t *TailSampling) keep(root *traceSpan, spans []*traceSpan) bool {
+	if root.isDebug() {
+		return true
+	}
+	if t.MinDuration > 0 && time.Duration(root.Duration)*time.Microsecond >= t.MinDuration {
+		return true
+	}
+	minStatus := t.MinStatusCode
+	if minStatus <= 0 {
+		minStatus = 500
+	}
+	for _, s := range append(spans, root) {
+		if s.hasError(minStatus) {
+			return true
+		}
+	}
+	return false
+}
+
+// 有 error annotation, 或者 http.status_code >= minStatus
+func (s *traceSpan) hasError(minStatus int) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.BinAnnotation {
+		switch a.Key {
+		case "error":
+			return true
+		case "http.status_code":
+			if code, err := strconv.Atoi(a.Value); err == nil && code >= minStatus {
+				return true
+			}
+		}
+	}
+	return false
+}
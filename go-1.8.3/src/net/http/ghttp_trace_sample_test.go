@@ -0,0 +1,168 @@
+package http
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+var parseSampleHeaderTests = []struct {
+	v       string
+	sampled bool
+	decided bool
+}{
+	{"", false, false},
+	{"true", true, true},
+	{"TRUE", true, true},
+	{"1", true, true},
+	{"false", false, true},
+	{"False", false, true},
+	{"0", false, true},
+	{"yes", false, false},
+	{"2", false, false},
+}
+
+func TestParseSampleHeader(t *testing.T) {
+	for _, tt := range parseSampleHeaderTests {
+		sampled, decided := parseSampleHeader(tt.v)
+		if sampled != tt.sampled || decided != tt.decided {
+			t.Errorf("parseSampleHeader(%q) = %v, %v; want %v, %v", tt.v, sampled, decided, tt.sampled, tt.decided)
+		}
+	}
+}
+
+// 返回固定结果, 记下被调用的次数
+type countSampler struct {
+	sample bool
+	calls  int
+}
+
+func (s *countSampler) Sample(req *Request) bool {
+	s.calls++
+	return s.sample
+}
+
+func TestRouteSampler(t *testing.T) {
+	never := SamplePolicyFunc(func(*Request) bool { return false })
+	always := SamplePolicyFunc(func(*Request) bool { return true })
+	rules := []RouteSampleRule{
+		{Prefix: "/health", Policy: never},
+		{Prefix: "/api/", Method: "POST", Policy: always},
+		{Prefix: "/api/", Policy: never},
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		def    bool
+		want   bool
+		useDef bool
+	}{
+		{"GET", "/health", true, false, false},
+		{"GET", "/healthz", true, false, false},
+		{"POST", "/api/users", false, true, false},
+		{"GET", "/api/users", true, false, false},
+		{"GET", "/other", true, true, true},
+		{"GET", "/other", false, false, true},
+	}
+	for _, tt := range tests {
+		def := &countSampler{sample: tt.def}
+		p := RouteSampler(rules, def)
+		req := &Request{Method: tt.method, URL: &url.URL{Path: tt.path}}
+		if got := p.Sample(req); got != tt.want {
+			t.Errorf("%s %s: Sample = %v; want %v", tt.method, tt.path, got, tt.want)
+		}
+		if used := def.calls > 0; used != tt.useDef {
+			t.Errorf("%s %s: default policy used = %v; want %v", tt.method, tt.path, used, tt.useDef)
+		}
+	}
+
+	// 没有 def 时都记录
+	if !RouteSampler(rules, nil).Sample(&Request{Method: "GET", URL: &url.URL{Path: "/other"}}) {
+		t.Errorf("RouteSampler with nil default: Sample = false; want true")
+	}
+}
+
+// 改了传进去的 rules 不影响已经建好的 RouteSampler
+func TestRouteSamplerCopiesRules(t *testing.T) {
+	never := SamplePolicyFunc(func(*Request) bool { return false })
+	always := SamplePolicyFunc(func(*Request) bool { return true })
+	rules := []RouteSampleRule{{Prefix: "/", Policy: never}}
+	p := RouteSampler(rules, nil)
+	rules[0].Policy = always
+	if p.Sample(&Request{URL: &url.URL{Path: "/x"}}) {
+		t.Errorf("Sample = true after changing the caller's rules; want false")
+	}
+}
+
+func TestRateLimitSampler(t *testing.T) {
+	tests := []struct {
+		perSecond int
+		calls     int
+		want      int
+	}{
+		{0, 3, 0},
+		{1, 3, 1},
+		{3, 3, 3},
+		{3, 10, 3},
+	}
+	for _, tt := range tests {
+		// 跨过秒的边界时计数会清零, 重试
+		for try := 0; ; try++ {
+			s := RateLimitSampler(tt.perSecond)
+			start := time.Now().Unix()
+			n := 0
+			for i := 0; i < tt.calls; i++ {
+				if s.Sample(nil) {
+					n++
+				}
+			}
+			if time.Now().Unix() != start && try < 3 {
+				continue
+			}
+			if n != tt.want {
+				t.Errorf("RateLimitSampler(%d): %d of %d sampled; want %d", tt.perSecond, n, tt.calls, tt.want)
+			}
+			break
+		}
+	}
+}
+
+// tags 是 key, value 交替
+func newTestSpan(duration time.Duration, flags string, tags ...string) *traceSpan {
+	s := &traceSpan{Duration: int64(duration / time.Microsecond), flags: flags}
+	ep := &endpoint{}
+	for i := 0; i+1 < len(tags); i += 2 {
+		s.addBinAnnotation(ep, tags[i], tags[i+1])
+	}
+	return s
+}
+
+func TestTailSamplingKeep(t *testing.T) {
+	fast := newTestSpan(10*time.Millisecond, "", "http.status_code", "200")
+	tests := []struct {
+		name string
+		t    TailSampling
+		root *traceSpan
+		kids []*traceSpan
+		want bool
+	}{
+		{"fast ok", TailSampling{MinDuration: time.Second}, fast, nil, false},
+		{"slow", TailSampling{MinDuration: time.Second}, newTestSpan(2*time.Second, ""), nil, true},
+		{"exactly MinDuration", TailSampling{MinDuration: time.Second}, newTestSpan(time.Second, ""), nil, true},
+		{"no MinDuration", TailSampling{}, newTestSpan(time.Hour, ""), nil, false},
+		{"debug flag", TailSampling{}, newTestSpan(0, "1"), nil, true},
+		{"root 500", TailSampling{}, newTestSpan(0, "", "http.status_code", "500"), nil, true},
+		{"root 404", TailSampling{}, newTestSpan(0, "", "http.status_code", "404"), nil, false},
+		{"root 404 MinStatusCode 400", TailSampling{MinStatusCode: 400}, newTestSpan(0, "", "http.status_code", "404"), nil, true},
+		{"root error", TailSampling{}, newTestSpan(0, "", "error", "EOF"), nil, true},
+		{"child error", TailSampling{}, fast, []*traceSpan{fast, newTestSpan(0, "", "error", "timeout")}, true},
+		{"child 503", TailSampling{}, fast, []*traceSpan{newTestSpan(0, "", "http.status_code", "503")}, true},
+		{"children ok", TailSampling{}, fast, []*traceSpan{fast, fast}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.t.keep(tt.root, tt.kids); got != tt.want {
+			t.Errorf("%s: keep = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,12 +2,13 @@ package http
 
 import (
 	"encoding/json"
-	"fmt"
+	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +26,21 @@ const (
 	FIELD_FLAGS     = "X-W-Flags"
 )
 
+// FIELD_* 规范化以后的 key, 按上面的顺序. FIELD_* 不是规范的写法, h.Get 每次都要转换, 会分配内存
+var traceHeaderKeys = [...]string{
+	CanonicalHeaderKey(FIELD_TRACE_ID),
+	CanonicalHeaderKey(FIELD_SPAN_ID),
+	CanonicalHeaderKey(FIELD_PARENT_ID),
+	CanonicalHeaderKey(FIELD_SIMPLE),
+	CanonicalHeaderKey(FIELD_FLAGS),
+}
+
+const (
+	// X-W-Flags 的 debug 位: 不管采样策略都记录, tail sampling 不丢,
+	// 并且记录请求期间协程的创建和阻塞
+	FLAG_DEBUG = 1
+)
+
 //
 type endpoint struct {
 	ServiceName string `json:"serviceName"` // require
@@ -66,34 +82,82 @@ type traceSpan struct {
 	flags         string          `json:"-"`
 	isSample      bool            `json:"-"`
 	isRecvReq     bool            `json:"-"`
+	isRoot        bool            `json:"-"` // 这个 span 开始了一个新的 trace, 记 trace.root=true
+	tailDecided   bool            `json:"-"` // server span 结束时, tail sampling 已经决定了要不要报告
+	tailKeep      bool            `json:"-"`
+	tailSent      bool            `json:"-"` // 已经交给 spansChan
 	gid           int64           `json:"-"`
 	localPort     uint16          `json:"-"` // for server
+	root          *traceSpan      `json:"-"` // 所在请求的 server span
+	finished      bool            `json:"-"` // logTrace 之后不能再加 annotation
+	logLines      int             `json:"-"` // 记下的 log 行数
 	sync.Mutex    `json:"-"`
 }
 
 // 从 header 设置 span
 func (s *traceSpan) setHeader(h Header) {
-	h.Set(FIELD_TRACE_ID, s.TraceId)
-	h.Set(FIELD_SPAN_ID, s.SpanId)
-	h.Set(FIELD_PARENT_ID, s.ParentId)
+	s.rangeHeader(h.Set)
+}
+
+// 要传给下游的 trace 信息
+func (s *traceSpan) rangeHeader(fun func(key, value string)) {
+	fun(FIELD_TRACE_ID, s.TraceId)
+	fun(FIELD_SPAN_ID, s.SpanId)
+	fun(FIELD_PARENT_ID, s.ParentId)
 	if s.isSample {
-		h.Set(FIELD_SIMPLE, "true")
+		fun(FIELD_SIMPLE, "true")
 	} else {
-		h.Set(FIELD_SIMPLE, "false")
+		fun(FIELD_SIMPLE, "false")
 	}
-	h.Set(FIELD_FLAGS, s.flags)
+	fun(FIELD_FLAGS, s.flags)
 }
 
 // 从 header 设置 span
-func (s *traceSpan) fromHeader(h Header) {
-	s.TraceId = h.Get(FIELD_TRACE_ID)
-	s.SpanId = h.Get(FIELD_SPAN_ID)
-	s.ParentId = h.Get(FIELD_PARENT_ID)
-	s.isSample = true
-	if h.Get(FIELD_SPAN_ID) == "false" {
-		s.isSample = false
+func (s *traceSpan) fromTraceHeader(th traceHeader) {
+	s.TraceId = th.traceId
+	s.SpanId = th.spanId
+	if s.TraceId == "" {
+		s.TraceId = genTraceId()
+	}
+	if s.SpanId == "" {
+		s.SpanId = genSpanId()
 	}
-	s.flags = h.Get(FIELD_FLAGS)
+	s.ParentId = th.parentId
+	s.flags = th.flags
+	s.isSample = th.sampled
+	s.isRoot = th.root
+}
+
+// 请求 header 里的 trace 信息, 在栈上解析, 决定采样之前不分配 traceSpan
+type traceHeader struct {
+	traceId  string
+	spanId   string
+	parentId string
+	flags    string
+	sampled  bool
+	decided  bool // X-W-Sample 里有明确的值
+	root     bool // 没有 trace 信息, 新开的 trace
+}
+
+//
+func parseTraceHeader(h Header) (th traceHeader) {
+	th.traceId = normalizeTraceId(h.get(traceHeaderKeys[0]))
+	th.spanId = normalizeSpanId(h.get(traceHeaderKeys[1]))
+	th.parentId = normalizeSpanId(h.get(traceHeaderKeys[2]))
+	th.sampled, th.decided = parseSampleHeader(h.get(traceHeaderKeys[3]))
+	th.flags = h.get(traceHeaderKeys[4])
+	if isDebugFlags(th.flags) {
+		th.sampled, th.decided = true, true
+	}
+
+	// 没有 trace 信息的请求 (浏览器, curl), 新开一个 trace. 决定采样之前不生成 id,
+	// 没采样的用到时才生成
+	if th.traceId == "" {
+		th.spanId = ""
+		th.parentId = ""
+		th.root = true
+	}
+	return
 }
 
 // 从父 span 拷贝数据
@@ -102,10 +166,38 @@ func (s *traceSpan) fromParentSpan(span *traceSpan) {
 	s.ParentId = span.SpanId
 	s.isSample = span.isSample
 	s.flags = span.flags
+	s.root = span.recvSpan()
+}
+
+// X-W-Flags 里有 FLAG_DEBUG
+func (s *traceSpan) isDebug() bool {
+	return isDebugFlags(s.flags)
 }
 
 //
-func (s *traceSpan) addAnnotation(ep *endpoint, ts int64, value string) {
+func isDebugFlags(s string) bool {
+	if s == "" {
+		return false
+	}
+	flags, err := strconv.ParseUint(s, 10, 64)
+	return err == nil && flags&FLAG_DEBUG != 0
+}
+
+// 所在请求的 server span, 不在请求里返回 nil
+func (s *traceSpan) recvSpan() *traceSpan {
+	if s.isRecvReq {
+		return s
+	}
+	return s.root
+}
+
+// 返回 false 表示 span 已经记录了, 没加上
+func (s *traceSpan) addAnnotation(ep *endpoint, ts int64, value string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return false
+	}
 	if s.Annotation == nil {
 		s.Annotation = []annotation{
 			annotation{
@@ -122,10 +214,16 @@ func (s *traceSpan) addAnnotation(ep *endpoint, ts int64, value string) {
 				Value:     value,
 			})
 	}
+	return true
 }
 
-//
-func (s *traceSpan) addBinAnnotation(ep *endpoint, key, value string) {
+// 返回 false 表示 span 已经记录了, 没加上
+func (s *traceSpan) addBinAnnotation(ep *endpoint, key, value string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return false
+	}
 	if s.BinAnnotation == nil {
 		s.BinAnnotation = []binAnnotation{
 			binAnnotation{
@@ -142,6 +240,30 @@ func (s *traceSpan) addBinAnnotation(ep *endpoint, key, value string) {
 				Value:    value,
 			})
 	}
+	return true
+}
+
+// 返回 false 表示 span 已经记录了, 没改
+func (s *traceSpan) setName(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return false
+	}
+	s.Name = name
+	return true
+}
+
+// 找不到返回 ""
+func (s *traceSpan) getBinAnnotation(key string) string {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.BinAnnotation {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
 }
 
 //
@@ -155,6 +277,7 @@ func newEndpoint(srvName, ip string, port uint16) *endpoint {
 
 //
 func newTraceSpan() *traceSpan {
+	atomic.AddInt64(&traceOverhead.allocated, 1)
 	s := traceSpan{
 		Timestamp: getTraceTime(),
 		Version:   PROBE_VER,
@@ -174,15 +297,9 @@ func (s *traceSpan) addChildSpan(s2 *traceSpan) {
 	s.childSpans = append(s.childSpans, s2)
 }
 
-//
-func genSpanId() string {
-	t := time.Now().UnixNano()
-	return fmt.Sprintf("%x", t)
-}
-
 //
 func getTraceTime() int64 {
-	t := time.Now()
+	t := traceClock()
 	return t.UnixNano() / 1e3
 }
 
@@ -192,21 +309,17 @@ func getTraceTime() int64 {
 // return getAddrFromString(addr)
 // }
 
-//
+// "ip:port", 没有端口时是 80
 func getAddrFromString(addr string) (ip string, port uint16) {
-	s := strings.Split(addr, ":")
-	ip = s[0]
 	port = uint16(80)
-	fmt.Printf("getAddrFromString : %##v\n", s)
-	if len(s) > 1 {
-		if port64, err := strconv.ParseUint(s[1], 10, 16); err == nil {
-			port = uint16(port64)
-			fmt.Println(port, port64)
-		} else {
-			fmt.Println(err, port, port64)
-		}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, port
 	}
-	return
+	if port64, err := strconv.ParseUint(p, 10, 16); err == nil {
+		port = uint16(port64)
+	}
+	return host, port
 }
 
 //
@@ -244,7 +357,27 @@ var (
 )
 
 func logTrace(span *traceSpan) {
-	spansChan <- span
+	span.Lock()
+	span.finished = true
+	span.Unlock()
+	if !span.isSample {
+		return
+	}
+	for _, s := range tailSampleSpans(span) {
+		spansChan <- s
+	}
+}
+
+// 交给 SpanReporter, 出错只打 log
+func reportSpans(spans []*traceSpan) {
+	b, err := json.Marshal(spans)
+	if err != nil {
+		log.Printf("http: trace marshal error: %v", err)
+		return
+	}
+	if err := getSpanReporter().Report(b); err != nil {
+		log.Printf("http: trace report error: %v", err)
+	}
 }
 
 func init() {
@@ -258,32 +391,27 @@ func init() {
 			if idx <= 0 {
 				return
 			}
-			if b, err := json.Marshal(traceSpanCache[:idx]); err == nil {
-
-				if f, err := os.OpenFile(fmt.Sprintf("./trace_%s_%d.txt", time.Now().Format("2006-01-02"), os.Getpid()),
-					os.O_APPEND|os.O_RDWR|os.O_CREATE,
-					0755); err == nil {
-					f.Write(b)
-					f.Close()
-				} else {
-					panic(err)
-				}
-				idx = 0
-			} else {
-				panic(err)
-			}
+			reportSpans(traceSpanCache[:idx])
+			idx = 0
 		}
 
 		for {
 			select {
 			case span := <-spansChan:
-				if idx >= 1024 {
-					flushFunc()
+				start := time.Now()
+				atomic.AddInt64(&traceOverhead.reported, 1)
+				if processSpan(span) {
+					if idx >= 1024 {
+						flushFunc()
+					}
+					traceSpanCache[idx] = span
+					idx++
 				}
-				traceSpanCache[idx] = span
-				idx++
+				addTraceProcessTime(start)
 			case <-t.C:
+				start := time.Now()
 				flushFunc()
+				addTraceProcessTime(start)
 			}
 		}
 	}()
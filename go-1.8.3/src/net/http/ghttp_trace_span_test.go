@@ -0,0 +1,191 @@
+package http
+
+import (
+	"net"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 测试里不写 trace 文件
+type discardSpanReporter struct{}
+
+func (discardSpanReporter) Report(batch []byte) error { return nil }
+
+// 测试期间记录下来的 span 发到返回的 chan, stop 恢复原来的 SpanProcessor 和 SpanReporter
+func captureSpans() (spans <-chan *traceSpan, stop func()) {
+	ch := make(chan *traceSpan, 100)
+	SetSpanReporter(discardSpanReporter{})
+	spanProcessorsMu.Lock()
+	saved := spanProcessors
+	spanProcessors = append(saved[:len(saved):len(saved)], func(r *SpanRecord) bool {
+		select {
+		case ch <- r.span:
+		default:
+		}
+		return true
+	})
+	spanProcessorsMu.Unlock()
+	return ch, func() {
+		spanProcessorsMu.Lock()
+		spanProcessors = saved
+		spanProcessorsMu.Unlock()
+		SetSpanReporter(nil)
+	}
+}
+
+// 等 n 个 span, 按记录的顺序
+func waitSpans(t *testing.T, spans <-chan *traceSpan, n int) []*traceSpan {
+	var ret []*traceSpan
+	timeout := time.After(5 * time.Second)
+	for len(ret) < n {
+		select {
+		case s := <-spans:
+			ret = append(ret, s)
+		case <-timeout:
+			t.Fatalf("got %d spans; want %d", len(ret), n)
+		}
+	}
+	return ret
+}
+
+// 没有返回 ""
+func spanTag(s *traceSpan, key string) string {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.BinAnnotation {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// 采样的根 span
+func newSampledSpan(name string) *traceSpan {
+	s := newTraceSpan()
+	s.TraceId = genTraceId()
+	s.SpanId = genSpanId()
+	s.Name = name
+	s.isSample = true
+	return s
+}
+
+// 只有 LocalAddr 的连接, onHttpProcRecvReq 只用到它
+type localAddrConn struct {
+	net.Conn
+}
+
+func (localAddrConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+}
+
+// 按 header 收到的一个请求
+func newTestResponse(h Header) *response {
+	req := &Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/"},
+		Host:       "example.com",
+		Header:     h,
+		RemoteAddr: "10.0.0.2:1234",
+	}
+	return &response{conn: &conn{rwc: localAddrConn{}}, req: req}
+}
+
+// 按 header 收一个请求, 返回 server span
+func recvTestRequest(h Header) *traceSpan {
+	return onHttpProcRecvReq(newTestResponse(h))
+}
+
+//
+func isHexId(id string, width int) bool {
+	return len(id) == width && normalizeId(id, width) == id
+}
+
+func TestServerSpanRoot(t *testing.T) {
+	defer saveCurEntry()()
+	const (
+		traceId = "463ac35c9f6413ad"
+		spanId  = "48485a3953bb6124"
+	)
+	tests := []struct {
+		name              string
+		traceId, spanId   string
+		root              bool   // 新开一个 trace
+		wantTrace, wantId string // 不是 root 时保留的 id, "" 表示新生成的
+	}{
+		{"no header", "", "", true, "", ""},
+		{"zero trace id", "0000000000000000", spanId, true, "", ""},
+		{"invalid trace id", "not-a-trace-id", spanId, true, "", ""},
+		{"too long trace id", traceId + traceId + "0", spanId, true, "", ""},
+		{"valid", traceId, spanId, false, traceId, spanId},
+		{"upper case", "463AC35C9F6413AD", "48485A3953BB6124", false, traceId, spanId},
+		{"zero span id", traceId, "0", false, traceId, ""},
+		{"invalid span id", traceId, "xyz", false, traceId, ""},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		h := Header{}
+		h.Set(FIELD_SIMPLE, "true")
+		if tt.traceId != "" {
+			h.Set(FIELD_TRACE_ID, tt.traceId)
+		}
+		if tt.spanId != "" {
+			h.Set(FIELD_SPAN_ID, tt.spanId)
+		}
+		span := recvTestRequest(h)
+		spanTable.delSpan(runtime.Getgid())
+		if span == nil {
+			t.Fatalf("%s: no span for a sampled request", tt.name)
+		}
+		if span.isRoot != tt.root || (spanTag(span, "trace.root") == "true") != tt.root {
+			t.Errorf("%s: isRoot = %v, trace.root = %q; want root %v", tt.name, span.isRoot, spanTag(span, "trace.root"), tt.root)
+		}
+		if tt.root && span.ParentId != "" {
+			t.Errorf("%s: root span has parent %q", tt.name, span.ParentId)
+		}
+		if tt.wantTrace != "" && span.TraceId != tt.wantTrace {
+			t.Errorf("%s: trace id = %q; want %q", tt.name, span.TraceId, tt.wantTrace)
+		}
+		if tt.wantTrace == "" && (!isHexId(span.TraceId, 16) || seen[span.TraceId]) {
+			t.Errorf("%s: trace id = %q; want a fresh one", tt.name, span.TraceId)
+		}
+		if tt.wantId != "" && span.SpanId != tt.wantId {
+			t.Errorf("%s: span id = %q; want %q", tt.name, span.SpanId, tt.wantId)
+		}
+		if tt.wantId == "" && (!isHexId(span.SpanId, 16) || seen[span.SpanId]) {
+			t.Errorf("%s: span id = %q; want a fresh one", tt.name, span.SpanId)
+		}
+		seen[span.TraceId], seen[span.SpanId] = true, true
+	}
+}
+
+func TestParseTraceHeaderDebug(t *testing.T) {
+	tests := []struct {
+		sample, flags    string
+		sampled, decided bool
+	}{
+		{"false", "1", true, true},
+		{"", "1", true, true},
+		{"false", "3", true, true},
+		{"false", "2", false, true},
+		{"", "2", false, false},
+		{"false", "x", false, true},
+	}
+	for _, tt := range tests {
+		h := Header{}
+		if tt.sample != "" {
+			h.Set(FIELD_SIMPLE, tt.sample)
+		}
+		h.Set(FIELD_FLAGS, tt.flags)
+		th := parseTraceHeader(h)
+		if th.sampled != tt.sampled || th.decided != tt.decided {
+			t.Errorf("X-W-Sample %q, X-W-Flags %q: sampled, decided = %v, %v; want %v, %v",
+				tt.sample, tt.flags, th.sampled, th.decided, tt.sampled, tt.decided)
+		}
+		if th.flags != tt.flags {
+			t.Errorf("X-W-Flags %q: flags = %q", tt.flags, th.flags)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package http_test
+
+import (
+	"context"
+	"io/ioutil"
+	. "net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 测试里不写 trace 文件
+type discardSpanReporter struct{}
+
+func (discardSpanReporter) Report(batch []byte) error { return nil }
+
+// 后端收到的 X-W-ParentId 就是发请求的 client span 的父 span
+func newParentIdServer() (*httptest.Server, <-chan string) {
+	parentIds := make(chan string, 1)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		parentIds <- r.Header.Get("X-W-ParentId")
+	}))
+	return ts, parentIds
+}
+
+func getWithContext(t *testing.T, ctx context.Context, url string) {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	res, err := DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+}
+
+func TestTraceClientParent(t *testing.T) {
+	SetSpanReporter(discardSpanReporter{})
+	defer SetSpanReporter(nil)
+
+	backend, parentIds := newParentIdServer()
+	defer backend.Close()
+
+	// 在所有请求之前启动, 不是任何 server span 的后代协程
+	jobs := make(chan context.Context)
+	done := make(chan bool)
+	go func() {
+		for ctx := range jobs {
+			getWithContext(t, ctx, backend.URL)
+			done <- true
+		}
+	}()
+	defer close(jobs)
+
+	tests := []struct {
+		name    string
+		handler func(r *Request) (wantParent string)
+	}{
+		{
+			// 不带 ctx, 沿协程链找到 server span
+			name: "ancestry",
+			handler: func(r *Request) string {
+				_, spanId, _ := TraceIdsFromContext(r.Context())
+				getWithContext(t, nil, backend.URL)
+				return spanId
+			},
+		},
+		{
+			// 协程链上没有 span, 用 ctx 里的 server span
+			name: "context from untraced goroutine",
+			handler: func(r *Request) string {
+				_, spanId, _ := TraceIdsFromContext(r.Context())
+				jobs <- r.Context()
+				<-done
+				return spanId
+			},
+		},
+		{
+			// 协程链上是 server span, ctx 里是本地 span, 先用 ctx
+			name: "context over ancestry",
+			handler: func(r *Request) string {
+				s, ctx := StartSpanContext(r.Context(), "local")
+				s.Finish()
+				_, spanId, _ := TraceIdsFromContext(ctx)
+				getWithContext(t, ctx, backend.URL)
+				return spanId
+			},
+		},
+	}
+	for _, tt := range tests {
+		wantParent := make(chan string, 1)
+		front := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+			wantParent <- tt.handler(r)
+		}))
+		getWithContext(t, nil, front.URL)
+		front.Close()
+
+		want := <-wantParent
+		got := <-parentIds
+		if want == "" {
+			t.Errorf("%s: handler not in a trace", tt.name)
+		} else if got != want {
+			t.Errorf("%s: client span parent = %q; want %q", tt.name, got, want)
+		}
+	}
+}
+
+// 上游带着 X-W-Sample: false 的请求, 用 Transport 发, 不经过 client 的 trace
+func benchmarkServeUnsampled(b *testing.B) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	defer ts.Close()
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	req.Header.Set("X-W-TraceId", "463ac35c9f6413ad")
+	req.Header.Set("X-W-SpanId", "48485a3953bb6124")
+	req.Header.Set("X-W-Sample", "false")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := DefaultTransport.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+}
+
+// server 只在 ctx 里放 unsampled, 不分配 span, 不进 spanTable
+func BenchmarkServeUnsampled(b *testing.B) {
+	SetSpanReporter(discardSpanReporter{})
+	defer SetSpanReporter(nil)
+	benchmarkServeUnsampled(b)
+}
+
+// 和 BenchmarkServeUnsampled 对比
+func BenchmarkServeTraceDisabled(b *testing.B) {
+	SetHttpTrace(false)
+	defer SetHttpTrace(true)
+	benchmarkServeUnsampled(b)
+}
+
+// 不在 trace 里的协程用 Client 发请求
+func benchmarkClientGet(b *testing.B) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	defer ts.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := Get(ts.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+}
+
+// 新开的 trace 都不采样, client 只传 header
+func BenchmarkClientUnsampled(b *testing.B) {
+	SetSpanReporter(discardSpanReporter{})
+	defer SetSpanReporter(nil)
+	SetSamplePolicy(SamplePolicyFunc(func(*Request) bool { return false }))
+	defer SetSamplePolicy(nil)
+	benchmarkClientGet(b)
+}
+
+// 和 BenchmarkClientUnsampled 对比
+func BenchmarkClientTraceDisabled(b *testing.B) {
+	SetHttpTrace(false)
+	defer SetHttpTrace(true)
+	benchmarkClientGet(b)
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"context"
+	"sync"
+)
+
+// 没采样的请求不分配 traceSpan 和 annotation, 也不进 spanTable, 只有一个 unsampledTrace,
+// 它自己就是 req.Context(), 发请求时照样把 trace 信息传给下游.
+// 协程链上找不到没采样的请求, 要带着 ctx 发请求, 或者用 TraceToken
+
+// req.Context() 里没采样的请求. 没有 trace 信息的请求 traceId, spanId 用到时才生成
+type unsampledTrace struct {
+	context.Context
+	traceId string
+	spanId  string
+	flags   string
+	once    sync.Once
+}
+
+// 和 context.WithValue 一样, 少分配一次
+func (u *unsampledTrace) Value(key interface{}) interface{} {
+	if key == traceSpanContextKey {
+		return u
+	}
+	if u.Context == nil {
+		return nil
+	}
+	return u.Context.Value(key)
+}
+
+// 没有的现在生成
+func (u *unsampledTrace) ids() (traceId, spanId string) {
+	u.once.Do(func() {
+		if u.traceId == "" {
+			u.traceId = genTraceId()
+		}
+		if u.spanId == "" {
+			u.spanId = genSpanId()
+		}
+	})
+	return u.traceId, u.spanId
+}
+
+// 从 ctx 里找没采样的请求, 没有返回 nil
+func getUnsampledFromContext(ctx context.Context) *unsampledTrace {
+	if ctx == nil {
+		return nil
+	}
+	u, _ := ctx.Value(traceSpanContextKey).(*unsampledTrace)
+	return u
+}
+
+// 发给下游的请求, parent 是 u
+func (u *unsampledTrace) setHeader(h Header) {
+	traceId, spanId := u.ids()
+	setUnsampledHeader(h, traceId, spanId, u.flags)
+}
+
+//
+func (u *unsampledTrace) rangeHeader(fun func(key, value string)) {
+	traceId, spanId := u.ids()
+	rangeUnsampledHeader(fun, traceId, spanId, u.flags)
+}
+
+// 不记录 span, 只生成新的 spanId 传给下游. 几个值放在一个数组里, 只分配一次
+func setUnsampledHeader(h Header, traceId, parentId, flags string) {
+	vals := []string{traceId, genSpanId(), parentId, "false", flags}
+	for i, k := range traceHeaderKeys {
+		h[k] = vals[i : i+1 : i+1]
+	}
+}
+
+//
+func rangeUnsampledHeader(fun func(key, value string), traceId, parentId, flags string) {
+	fun(FIELD_TRACE_ID, traceId)
+	fun(FIELD_SPAN_ID, genSpanId())
+	fun(FIELD_PARENT_ID, parentId)
+	fun(FIELD_SIMPLE, "false")
+	fun(FIELD_FLAGS, flags)
+}
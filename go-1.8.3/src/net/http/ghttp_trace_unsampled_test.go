@@ -0,0 +1,175 @@
+package http
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+type testContextKey struct{}
+
+func TestRecvReqUnsampled(t *testing.T) {
+	defer saveCurEntry()()
+	entries := atomic.LoadInt64(&spanEntries)
+	resp := newTestResponse(unsampledHeader())
+	parent := context.WithValue(context.Background(), testContextKey{}, "v")
+	resp.req.ctx = parent
+	if span := onHttpProcRecvReq(resp); span != nil {
+		t.Fatalf("span %+v for an unsampled request", span)
+	}
+	// 不进 spanTable, ctx 就是 unsampledTrace
+	if n := atomic.LoadInt64(&spanEntries); n != entries {
+		t.Errorf("spanTable entries = %d; want %d", n, entries)
+	}
+	if cur := getCurTrace(); !cur.empty() {
+		t.Errorf("current entry = %+v; want none", cur)
+	}
+	u, ok := resp.req.Context().(*unsampledTrace)
+	if !ok {
+		t.Fatalf("req.Context() = %T; want *unsampledTrace", resp.req.Context())
+	}
+	if getUnsampledFromContext(resp.req.Context()) != u || resp.req.Context().Value(testContextKey{}) != "v" {
+		t.Error("unsampled ctx lost itself or the parent's values")
+	}
+	if traceId, spanId, sampled := TraceIdsFromContext(resp.req.Context()); traceId != "463ac35c9f6413ad" || spanId != "48485a3953bb6124" || sampled {
+		t.Errorf("TraceIdsFromContext = %s, %s, %v", traceId, spanId, sampled)
+	}
+	onHttpSendResp(resp, nil)
+}
+
+// 没有 trace 信息的请求没采样, 用到 id 时才生成, 之后不变
+func TestRecvReqUnsampledRootIds(t *testing.T) {
+	defer saveCurEntry()()
+	defer neverSample()()
+	resp := newTestResponse(Header{})
+	onHttpProcRecvReq(resp)
+	defer onHttpSendResp(resp, nil)
+	u := getUnsampledFromContext(resp.req.Context())
+	if u == nil {
+		t.Fatal("no unsampled trace in req.Context()")
+	}
+	if u.traceId != "" || u.spanId != "" {
+		t.Errorf("ids %q, %q generated before they are used", u.traceId, u.spanId)
+	}
+
+	var parents []string
+	for i := 0; i < 2; i++ {
+		req := (&Request{Method: "GET", URL: &url.URL{Path: "/"}}).WithContext(resp.req.Context())
+		if span := onHttpSendReq(req); span != nil {
+			t.Fatalf("client span %+v in an unsampled request", span)
+		}
+		if req.Header.Get(FIELD_TRACE_ID) != u.traceId || !isHexId(u.traceId, 16) {
+			t.Errorf("X-W-TraceId = %q; want %q", req.Header.Get(FIELD_TRACE_ID), u.traceId)
+		}
+		if req.Header.Get(FIELD_SIMPLE) != "false" {
+			t.Errorf("X-W-Sample = %q; want false", req.Header.Get(FIELD_SIMPLE))
+		}
+		parents = append(parents, req.Header.Get(FIELD_PARENT_ID))
+	}
+	if parents[0] != u.spanId || parents[1] != u.spanId || !isHexId(u.spanId, 16) {
+		t.Errorf("X-W-ParentId = %v; want %s both times", parents, u.spanId)
+	}
+	if traceId, spanId, _ := TraceIdsFromContext(resp.req.Context()); traceId != u.traceId || spanId != u.spanId {
+		t.Errorf("TraceIdsFromContext = %s, %s; want %s, %s", traceId, spanId, u.traceId, u.spanId)
+	}
+}
+
+// 几个值共用一个数组, append 不能改到别的 header
+func TestSetUnsampledHeader(t *testing.T) {
+	h := Header{}
+	setUnsampledHeader(h, "463ac35c9f6413ad", "48485a3953bb6124", "1")
+	h.Add(FIELD_TRACE_ID, "x")
+	if got := h.Get(FIELD_SPAN_ID); !isHexId(got, 16) {
+		t.Errorf("X-W-SpanId = %q after appending to X-W-TraceId", got)
+	}
+	want := map[string]string{FIELD_PARENT_ID: "48485a3953bb6124", FIELD_SIMPLE: "false", FIELD_FLAGS: "1"}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("%s = %q; want %q", k, got, v)
+		}
+	}
+	if got := h[CanonicalHeaderKey(FIELD_TRACE_ID)]; len(got) != 2 || got[0] != "463ac35c9f6413ad" {
+		t.Errorf("X-W-TraceId = %v", got)
+	}
+}
+
+// 下面的 benchmark 只测 hook 本身, 不起 server, 和 SetHttpTrace(false) 对比
+
+// 上游带着 X-W-Sample: false
+func unsampledHeader() Header {
+	h := Header{}
+	h.Set(FIELD_TRACE_ID, "463ac35c9f6413ad")
+	h.Set(FIELD_SPAN_ID, "48485a3953bb6124")
+	h.Set(FIELD_SIMPLE, "false")
+	return h
+}
+
+// 新开的 trace 都不采样
+func neverSample() (restore func()) {
+	SetSamplePolicy(SamplePolicyFunc(func(*Request) bool { return false }))
+	return func() { SetSamplePolicy(nil) }
+}
+
+//
+func benchmarkRecvReq(b *testing.B, h Header) {
+	resp := newTestResponse(h)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp.req.ctx = nil
+		onHttpSendResp(resp, onHttpProcRecvReq(resp))
+	}
+}
+
+func BenchmarkRecvReqUnsampled(b *testing.B) {
+	benchmarkRecvReq(b, unsampledHeader())
+}
+
+// 没有 trace 信息, 采样策略不采样
+func BenchmarkRecvReqUnsampledRoot(b *testing.B) {
+	defer neverSample()()
+	benchmarkRecvReq(b, Header{})
+}
+
+func BenchmarkRecvReqTraceDisabled(b *testing.B) {
+	SetHttpTrace(false)
+	defer SetHttpTrace(true)
+	benchmarkRecvReq(b, unsampledHeader())
+}
+
+// 在没采样的请求里发请求, 带着请求的 ctx
+func BenchmarkSendReqUnsampledContext(b *testing.B) {
+	resp := newTestResponse(unsampledHeader())
+	onHttpProcRecvReq(resp)
+	defer onHttpSendResp(resp, nil)
+	req := (&Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: Header{}}).WithContext(resp.req.Context())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		onHttpSendReq(req)
+	}
+}
+
+// 不在请求里的协程发请求, 采样策略不采样
+func BenchmarkSendReqUnsampledRoot(b *testing.B) {
+	defer saveCurEntry()()
+	defer neverSample()()
+	req := &Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		onHttpSendReq(req)
+	}
+}
+
+func BenchmarkSendReqTraceDisabled(b *testing.B) {
+	SetHttpTrace(false)
+	defer SetHttpTrace(true)
+	req := &Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		onHttpSendReq(req)
+	}
+}
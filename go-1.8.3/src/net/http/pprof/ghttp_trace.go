@@ -0,0 +1,60 @@
+package pprof
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// Index 里 /debug/pprof/ 下面 trace 相关的路径, 其它的返回 nil
+func traceHandler(name string) http.HandlerFunc {
+	switch name {
+	case "goroutine":
+		return traceGoroutine
+	case "goroutineleak":
+		return goroutineLeak
+	}
+	return nil
+}
+
+// /debug/pprof/goroutine?trace=<traceId> 或 ?span=<server spanId>
+// 只输出协程链属于这个请求的协程调用栈, 没有这两个参数时和原来的 goroutine profile 一样,
+// debug=2 时带上 runtime.SetGoroutineName 设置的名字
+func traceGoroutine(w http.ResponseWriter, r *http.Request) {
+	traceId, spanId := r.FormValue("trace"), r.FormValue("span")
+	if traceId == "" && spanId == "" {
+		if r.FormValue("debug") != "2" {
+			Handler("goroutine").ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := http.WriteGoroutines(w); err != nil {
+			fmt.Fprintf(w, "\nerror: %v\n", err)
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	n, err := http.WriteTraceGoroutines(&buf, traceId, spanId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	fmt.Fprintf(w, "trace=%s span=%s goroutines: %d\n\n", traceId, spanId, n)
+	w.Write(buf.Bytes())
+}
+
+// /debug/pprof/goroutineleak 列出 http.SetLeakDetector 检测到的泄漏协程
+func goroutineLeak(w http.ResponseWriter, r *http.Request) {
+	leaks := http.GoroutineLeaks()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutine leaks: %d\n\n", len(leaks))
+	for _, l := range leaks {
+		fmt.Fprintf(w, "trace=%s span=%s url=%s func=%s name=%s age=%v finished=%v\n%s\n",
+			l.TraceId, l.SpanId, l.Url, l.Func, l.Name, l.Age, l.Finished, l.Stack)
+	}
+}
@@ -0,0 +1,149 @@
+package pprof
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试里不写 trace 文件
+type discardSpanReporter struct{}
+
+func (discardSpanReporter) Report(batch []byte) error { return nil }
+
+// 请求处理中起的协程, 在 filter 的输出里按函数名找
+func traceTestBlocked(release <-chan bool) {
+	<-release
+}
+
+// 程序自己注册 /debug/pprof/goroutine 不能 panic
+func TestTraceGoroutineUserHandler(t *testing.T) {
+	mux := http.DefaultServeMux
+	mux.Handle("/debug/pprof/goroutine", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func TestTraceGoroutineFilter(t *testing.T) {
+	http.SetSpanReporter(discardSpanReporter{})
+	defer http.SetSpanReporter(nil)
+
+	type ids struct{ traceId, spanId string }
+	idc := make(chan ids, 1)
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceId, spanId, _ := http.TraceIdsFromContext(r.Context())
+		done := make(chan bool)
+		go func() {
+			traceTestBlocked(release)
+			close(done)
+		}()
+		idc <- ids{traceId, spanId}
+		<-done
+	}))
+	defer ts.Close()
+
+	go func() {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}()
+	id := <-idc
+	defer close(release)
+	if id.traceId == "" || id.spanId == "" {
+		t.Fatalf("no trace ids in handler: %+v", id)
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		want  bool
+	}{
+		{"trace=" + id.traceId, 200, true},
+		{"span=" + id.spanId, 200, true},
+		{"trace=" + id.traceId + "&span=" + id.spanId, 200, true},
+		{"trace=0123456789abcdef", 404, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		Index(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=2&"+tt.query, nil))
+		body := w.Body.String()
+		if w.Code != tt.code {
+			t.Errorf("%s: code = %d; want %d\n%s", tt.query, w.Code, tt.code, body)
+		}
+		if got := strings.Contains(body, "traceTestBlocked"); got != tt.want {
+			t.Errorf("%s: has traceTestBlocked = %v; want %v\n%s", tt.query, got, tt.want, body)
+		}
+		if tt.want && strings.Contains(body, "TestTraceGoroutineFilter(") {
+			t.Errorf("%s: test goroutine is not part of the request\n%s", tt.query, body)
+		}
+	}
+
+	// 没有 trace/span 参数时和原来的 goroutine profile 一样
+	w := httptest.NewRecorder()
+	Index(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine profile:") {
+		t.Errorf("goroutine profile: code = %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+// 请求结束后还在等的协程
+func traceTestLeaked(release <-chan bool) {
+	<-release
+}
+
+// 没采样的请求也要检测泄漏
+func TestGoroutineLeakUnsampled(t *testing.T) {
+	http.SetSpanReporter(discardSpanReporter{})
+	defer http.SetSpanReporter(nil)
+	http.SetLeakDetector(10*time.Millisecond, nil)
+	defer http.SetLeakDetector(0, nil)
+
+	release := make(chan bool)
+	defer close(release)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		go traceTestLeaked(release)
+	}))
+	defer ts.Close()
+
+	const traceId = "463ac35c9f6413ad"
+	req, _ := http.NewRequest("GET", ts.URL+"/leak?id=1", nil)
+	req.Header.Set("X-W-TraceId", traceId)
+	req.Header.Set("X-W-SpanId", "48485a3953bb6124")
+	req.Header.Set("X-W-Sample", "false")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var leak *http.GoroutineLeak
+	for deadline := time.Now().Add(5 * time.Second); leak == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		for _, l := range http.GoroutineLeaks() {
+			if l.TraceId == traceId {
+				l := l
+				leak = &l
+			}
+		}
+	}
+	if leak == nil {
+		t.Fatal("leak of the unsampled request not detected")
+	}
+	if !strings.Contains(leak.Func, "traceTestLeaked") || !strings.HasSuffix(leak.Url, "/leak?id=1") {
+		t.Errorf("leak = %+v; want func traceTestLeaked, url ending with /leak?id=1", leak)
+	}
+
+	w := httptest.NewRecorder()
+	Index(w, httptest.NewRequest("GET", "/debug/pprof/goroutineleak", nil))
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "trace="+traceId) || !strings.Contains(body, "traceTestLeaked") {
+		t.Errorf("goroutineleak: code = %d\n%s", w.Code, body)
+	}
+}
@@ -448,6 +448,9 @@ type response struct {
 	// non-nil. Make this lazily-created again as it used to be?
 	closeNotifyCh  chan bool
 	didCloseNotify int32 // atomic (only 0->1 winner should send)
+
+	// lbh trace 记录响应 body 的前几个字节, 没打开时为 nil
+	traceBody *bodySnippet
 }
 
 // TrailerPrefix is a magic prefix for ResponseWriter.Header map keys
@@ -649,6 +652,10 @@ func (cr *connReader) startBackgroundRead() {
 	}
 	cr.inRead = true
 	cr.conn.rwc.SetReadDeadline(time.Time{})
+	// lbh trace 不算请求处理期间创建的协程
+	if enableHttpTrace {
+		runtime.SkipgSpawn()
+	}
 	go cr.backgroundRead()
 }
 
@@ -1239,7 +1246,8 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 	// because we don't know if the next bytes on the wire will be
 	// the body-following-the-timer or the subsequent request.
 	// See Issue 11549.
-	if ecr, ok := w.req.Body.(*expectContinueReader); ok && !ecr.sawEOF {
+	// lbh trace 看 trace 包装前的 body
+	if ecr, ok := unwrapTraceReqBody(w.req.Body).(*expectContinueReader); ok && !ecr.sawEOF {
 		w.closeAfterReply = true
 	}
 
@@ -1253,7 +1261,8 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 	if w.req.ContentLength != 0 && !w.closeAfterReply {
 		var discard, tooBig bool
 
-		switch bdy := w.req.Body.(type) {
+		// lbh trace
+		switch bdy := unwrapTraceReqBody(w.req.Body).(type) {
 		case *expectContinueReader:
 			if bdy.resp.wroteContinue {
 				discard = true
@@ -1521,6 +1530,10 @@ func (w *response) write(lenData int, dataB []byte, dataS string) (n int, err er
 	if w.contentLength != -1 && w.written > w.contentLength {
 		return 0, ErrContentLength
 	}
+	// lbh trace
+	if w.traceBody != nil {
+		w.traceBody.write(dataB, dataS)
+	}
 	if dataB != nil {
 		return w.w.Write(dataB)
 	} else {
@@ -1580,7 +1593,8 @@ func (w *response) shouldReuseConnection() bool {
 }
 
 func (w *response) closedRequestBodyEarly() bool {
-	body, ok := w.req.Body.(*body)
+	// lbh trace
+	body, ok := unwrapTraceReqBody(w.req.Body).(*body)
 	return ok && body.didEarlyClose()
 }
 
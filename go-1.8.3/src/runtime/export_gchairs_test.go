@@ -0,0 +1,41 @@
+package runtime
+
+// 测试用假的 g 调协程创建和退出的 hook, gid 用很大的数, 不和真的协程冲突
+
+func GStartHook(gid, pid int64) {
+	onGStartHook(&g{goid: gid}, &g{goid: pid})
+}
+
+func GStopHook(gid int64) {
+	onGStopHook(&g{goid: gid})
+}
+
+// 当作过了 clearInterNano 以后清一遍所有的 cell
+func ClearExitedGp() {
+	now := nanotime() + clearInterNano + 1
+	for i := range gpCells {
+		gpCells[i].clearExited(now)
+	}
+}
+
+// 和 SetGoroutineName 一样, 给假的 gid 起名字
+func SetGname(gid int64, name string) {
+	gpCells[gid%cellSize].setName(gid, name)
+}
+
+// 和 SkipgSpawn 一样, 给假的 gid 用
+func SkipgSpawnFor(gid int64) {
+	gpCells[gid%cellSize].setSkipNext(gid)
+}
+
+// 当作 gid 从 start 阻塞到现在
+func GBlockHook(gid int64, reason string, start int64) {
+	onGBlockHook(&g{goid: gid}, reason, start)
+}
+
+func GBlockTracing() int32 {
+	lock(&gBlockLock)
+	n := gBlockTracing
+	unlock(&gBlockLock)
+	return n
+}
@@ -3,55 +3,295 @@ package runtime
 const (
 	cellSize       = 8
 	clearInterNano = 1e9 * 120
+	maxGSpawned    = 10000 // 被跟踪的协程一次最多记多少个 spawned
+	maxGBlocks     = 64    // 一个协程最多记多少次阻塞
+	minGBlockNano  = 1e5   // 短于 100us 的阻塞不记
 )
 
 var (
 	gpCells       [cellSize]gpCell = [cellSize]gpCell{}
 	scanGLastTime int64
 	curIdx        = 0
+
+	// 有 blocks 的协程记录个数, gopark 不加锁读, 为 0 时什么都不做
+	gBlockTracing int32
+	gBlockLock    mutex
 )
 
 //
 type gpCell struct {
-	infos [][4]int64
+	infos []gpInfo
+	index map[int64]int // gid -> infos 的下标
 	lock  mutex
 }
 
 //
-func (c *gpCell) add(gid, pid int64) {
+type gpInfo struct {
+	gid      int64
+	pid      int64
+	nano     int64      // 创建时间
+	val      int64      // 0 表示无效, 可以清掉
+	exitNano int64      // 退出时间, 0 表示还没退出
+	startpc  uintptr    // 协程入口函数
+	name     string     // SetGoroutineName 设置的名字
+	tracker  int64      // 最近的被跟踪 (ResetgPeak) 的祖先, 0 表示没有
+	epoch    int64      // 创建时 tracker 的 track
+	track    int64      // ResetgPeak 的次数, 0 表示没被跟踪, 后代协程的个数记在这里
+	descs    int64      // 这次 ResetgPeak 以来创建的, 还活着的后代协程个数
+	children int64      // 还在 gpCells 里的子协程记录个数, 不为 0 时退出了也不清, 子协程还能找到协程链
+	peak     int64      // 这次 ResetgPeak 以来 descs 的最大值
+	skipNext bool       // SkipgSpawn, 下一个创建的协程不算后代
+	spawned  []int64    // 最近一次 ResetgPeak 以来创建的后代, 按创建顺序
+	blocks   *gBlockLog // StartgBlockTrace 以来的阻塞, nil 表示不记
+}
+
+// 事先分配好, gopark 里记阻塞不分配内存
+type gBlockLog struct {
+	events  [maxGBlocks]GBlockEvent
+	n       int
+	dropped int
+}
+
+// GBlockEvent 是协程的一次阻塞 (gopark 到被唤醒后重新运行)
+type GBlockEvent struct {
+	Reason string // gopark 的 reason, 比如 "chan receive", "select", "IO wait"
+	Start  int64  // 和 Nanotime 同一个时钟
+	End    int64
+}
+
+//
+func addGBlockTracing(n int32) {
+	lock(&gBlockLock)
+	gBlockTracing += n
+	unlock(&gBlockLock)
+}
+
+// 调用时持有 c.lock
+func (c *gpCell) find(gid int64) *gpInfo {
+	if i, ok := c.index[gid]; ok {
+		return &c.infos[i]
+	}
+	return nil
+}
+
+//
+// blocks 为 true 时新协程也记阻塞
+func (c *gpCell) add(gid, pid int64, startpc uintptr, tracker, epoch int64, blocks bool) {
+	info := gpInfo{gid: gid, pid: pid, nano: nanotime(), val: 1, startpc: startpc, tracker: tracker, epoch: epoch}
+	if blocks {
+		info.blocks = new(gBlockLog)
+	}
 	lock(&c.lock)
-	if c.infos == nil {
-		c.infos = [][4]int64{}
+	if c.index == nil {
+		c.index = make(map[int64]int)
 	}
-	c.infos = append(c.infos, [4]int64{gid, pid, nanotime(), 1})
+	c.index[gid] = len(c.infos)
+	c.infos = append(c.infos, info)
 	unlock(&c.lock)
+	if blocks {
+		addGBlockTracing(1)
+	}
 }
 
 //
 func (c *gpCell) get(gid int64) int64 {
+	ret := int64(-1)
 	lock(&c.lock)
-	if c.infos == nil {
-		unlock(&c.lock)
-		return -1
+	if info := c.find(gid); info != nil {
+		ret = info.pid
 	}
+	unlock(&c.lock)
+	return ret
+}
 
-	ret := int64(-1)
-	nano := int64(0)
+//
+func (c *gpCell) setName(gid int64, name string) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		info.name = name
+	}
+	unlock(&c.lock)
+}
+
+//
+func (c *gpCell) getName(gid int64) string {
+	name := ""
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		name = info.name
+	}
+	unlock(&c.lock)
+	return name
+}
+
+// 协程退出, 记下退出时间, 返回它的 tracker 和创建时 tracker 的 epoch
+func (c *gpCell) exit(gid int64) (tracker, epoch int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && info.exitNano == 0 {
+		info.exitNano = nanotime()
+		info.val = 0
+		info.spawned = nil
+		tracker, epoch = info.tracker, info.epoch
+	}
+	unlock(&c.lock)
+	return
+}
 
-	for _, v := range c.infos {
-		if v[0] == gid {
-			if nano < v[2] {
-				ret = v[1]
-				nano = v[2]
+// pid 创建了一个协程, 返回新协程的 tracker: pid 被跟踪就是 pid, 否则和 pid 一样.
+// pid 调过 SkipgSpawn 的, 新协程不跟踪, 也不记阻塞. pid 在记阻塞的, 新协程也记
+func (c *gpCell) addChild(pid int64) (tracker, epoch int64, blocks bool) {
+	lock(&c.lock)
+	if info := c.find(pid); info != nil {
+		info.children++
+		if info.skipNext {
+			info.skipNext = false
+		} else {
+			if info.track > 0 {
+				tracker, epoch = pid, info.track
 			} else {
-				v[3] = 0
+				tracker, epoch = info.tracker, info.epoch
 			}
+			blocks = info.blocks != nil
 		}
 	}
 	unlock(&c.lock)
+	return
+}
+
+// epoch 那次 ResetgPeak 之后创建的后代退出了, 之前的后代不在 descs 里, 不减
+func (c *gpCell) exitDesc(gid, epoch int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && epoch == info.track {
+		info.descs--
+	}
+	unlock(&c.lock)
+}
+
+// 新的后代协程 child, 是在 epoch 那次 ResetgPeak 之后创建的协程的后代, 之前的不算
+func (c *gpCell) addSpawned(gid, child, epoch int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && epoch == info.track {
+		info.descs++
+		if info.descs > info.peak {
+			info.peak = info.descs
+		}
+		if len(info.spawned) < maxGSpawned {
+			info.spawned = append(info.spawned, child)
+		}
+	}
+	unlock(&c.lock)
+}
+
+//
+func (c *gpCell) setSkipNext(gid int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		info.skipNext = true
+	}
+	unlock(&c.lock)
+}
+
+// 子协程的记录清掉了
+func (c *gpCell) delChild(pid int64) {
+	lock(&c.lock)
+	if info := c.find(pid); info != nil {
+		info.children--
+	}
+	unlock(&c.lock)
+}
+
+//
+func (c *gpCell) getSpawned(gid int64) []int64 {
+	var ret []int64
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		ret = append(ret, info.spawned...)
+	}
+	unlock(&c.lock)
 	return ret
 }
 
+//
+func (c *gpCell) getInfo(gid int64) (GpInfo, bool) {
+	var ret GpInfo
+	lock(&c.lock)
+	info := c.find(gid)
+	if info != nil {
+		ret = info.export()
+	}
+	unlock(&c.lock)
+	return ret, info != nil
+}
+
+// gid 没被跟踪时 tracked 为 false
+func (c *gpCell) getDescs(gid int64) (live, peak int64, tracked bool) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && info.track > 0 {
+		live, peak, tracked = info.descs, info.peak, true
+	}
+	unlock(&c.lock)
+	return
+}
+
+//
+func (c *gpCell) startBlocks(gid int64) {
+	log := new(gBlockLog)
+	started := false
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && info.blocks == nil {
+		info.blocks = log
+		started = true
+	}
+	unlock(&c.lock)
+	if started {
+		addGBlockTracing(1)
+	}
+}
+
+// 拷贝出记下的阻塞, 不再记
+func (c *gpCell) stopBlocks(gid int64) (events []GBlockEvent, dropped int) {
+	var log *gBlockLog
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		log = info.blocks
+		info.blocks = nil
+	}
+	unlock(&c.lock)
+	if log == nil {
+		return nil, 0
+	}
+	addGBlockTracing(-1)
+	// 已经从记录上摘下来了, 不会再有人写
+	return append([]GBlockEvent(nil), log.events[:log.n]...), log.dropped
+}
+
+// 在 gopark 里调用, 不能分配内存
+func (c *gpCell) addBlock(gid int64, reason string, start, end int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil && info.blocks != nil {
+		log := info.blocks
+		if log.n < len(log.events) {
+			log.events[log.n] = GBlockEvent{Reason: reason, Start: start, End: end}
+			log.n++
+		} else {
+			log.dropped++
+		}
+	}
+	unlock(&c.lock)
+}
+
+// 开始新的一轮, 之前的后代不再算
+func (c *gpCell) resetPeak(gid int64) {
+	lock(&c.lock)
+	if info := c.find(gid); info != nil {
+		info.track++
+		info.descs = 0
+		info.peak = 0
+		info.spawned = info.spawned[:0]
+	}
+	unlock(&c.lock)
+}
+
 //
 func Getgpid(gid int64, rlt []int64) int {
 	if len(rlt) < 1 {
@@ -72,32 +312,53 @@ func Getgpid(gid int64, rlt []int64) int {
 	return i
 }
 
-//
+// 每 clearInterNano / cellSize 清一个 cell, 每个 cell 每 clearInterNano 清一次
 func scanGCellsValid() {
 	now := nanotime()
-	if now-scanGLastTime < clearInterNano {
+	if now-scanGLastTime < clearInterNano/cellSize {
 		return
 	}
 	scanGLastTime = now
 
 	idx := curIdx % cellSize
 	curIdx++
+	gpCells[idx].clearExited(now)
+}
 
-	lock(&gpCells[idx].lock)
-	if gpCells[idx].infos == nil {
-		unlock(&gpCells[idx].lock)
-		return
-	}
-
-	for k := 0; k < len(gpCells[idx].infos); k++ {
-		if gpCells[idx].infos[k][3] == 0 {
-			// if now-gpCells[idx].infos[k][2] > 1e3 {
-			gpCells[idx].infos = append(gpCells[idx].infos[:k], gpCells[idx].infos[k+1:]...)
-			k--
+// 清掉退出超过 clearInterNano 的协程记录. 还有子协程记录的不清, 协程链中间的协程退出了,
+// 活着的后代也能一直找到上面的祖先; 子协程的记录清掉以后, 下一轮再清它
+func (c *gpCell) clearExited(now int64) {
+	var pids []int64
+	blocks := int32(0)
+	lock(&c.lock)
+	n := 0
+	for k := range c.infos {
+		info := c.infos[k]
+		if info.val == 0 && now-info.exitNano > clearInterNano && info.children <= 0 {
+			delete(c.index, info.gid)
+			pids = append(pids, info.pid)
+			if info.blocks != nil {
+				blocks++
+			}
+			continue
 		}
+		c.infos[n] = info
+		c.index[info.gid] = n
+		n++
+	}
+	for k := n; k < len(c.infos); k++ {
+		c.infos[k] = gpInfo{}
+	}
+	c.infos = c.infos[:n]
+	unlock(&c.lock)
+	if blocks > 0 {
+		addGBlockTracing(-blocks)
 	}
 
-	unlock(&gpCells[idx].lock)
+	// 父协程可能在同一个 cell, 放锁以后再减
+	for _, pid := range pids {
+		gpCells[pid%cellSize].delChild(pid)
+	}
 }
 
 func DumpGpCells(fun func(gid, pid, nano, val int64)) {
@@ -105,20 +366,180 @@ func DumpGpCells(fun func(gid, pid, nano, val int64)) {
 		lock(&gpCells[i].lock)
 		if gpCells[i].infos != nil {
 			for _, v := range gpCells[i].infos {
-				fun(v[0], v[1], v[2], v[3])
+				fun(v.gid, v.pid, v.nano, v.val)
 			}
 		}
 		unlock(&gpCells[i].lock)
 	}
 }
 
+// DumpGpCellsNamed 和 DumpGpCells 一样, 多带 SetGoroutineName 设置的名字
+func DumpGpCellsNamed(fun func(gid, pid, nano, val int64, name string)) {
+	for i := 0; i < cellSize; i++ {
+		lock(&gpCells[i].lock)
+		for _, v := range gpCells[i].infos {
+			fun(v.gid, v.pid, v.nano, v.val, v.name)
+		}
+		unlock(&gpCells[i].lock)
+	}
+}
+
+// GpInfo 是 gpCells 里一条协程记录的拷贝
+type GpInfo struct {
+	Gid      int64
+	Pid      int64
+	Nano     int64   // 创建时间, 和 Nanotime 同一个时钟
+	ExitNano int64   // 退出时间, 0 表示还没退出
+	StartPC  uintptr // 协程入口函数, 可以用 FuncForPC 取函数名
+	Name     string  // SetGoroutineName 设置的名字
+}
+
+//
+func (v *gpInfo) export() GpInfo {
+	return GpInfo{Gid: v.gid, Pid: v.pid, Nano: v.nano, ExitNano: v.exitNano, StartPC: v.startpc, Name: v.name}
+}
+
+// CopyGpInfos 拷贝出 gpCells 里所有的协程记录, 不持锁回调, 可以在 fun 里调 Getgpid
+func CopyGpInfos() []GpInfo {
+	infos := []GpInfo{}
+	for i := 0; i < cellSize; i++ {
+		lock(&gpCells[i].lock)
+		for _, v := range gpCells[i].infos {
+			infos = append(infos, v.export())
+		}
+		unlock(&gpCells[i].lock)
+	}
+	return infos
+}
+
+// CopyGpSpawned 返回 ResetgPeak 以来 gid 创建的协程和它们的后代, 按创建顺序, 最多 maxGSpawned 个.
+// 只查这些协程自己的记录, 不用像 CopyGpInfos 那样拷贝所有协程
+func CopyGpSpawned(gid int64) []GpInfo {
+	infos := []GpInfo{}
+	for _, child := range gpCells[gid%cellSize].getSpawned(gid) {
+		if info, ok := gpCells[child%cellSize].getInfo(child); ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// GetGpInfo 返回 gid 的协程记录, 退出后清掉了返回 false
+func GetGpInfo(gid int64) (GpInfo, bool) {
+	return gpCells[gid%cellSize].getInfo(gid)
+}
+
+// SetGoroutineName 给当前协程起个名字, 在 DumpGpCellsNamed, net/http 输出的协程调用栈
+// (/debug/pprof/goroutine?debug=2) 和协程 span 里显示.
+// runtime.Stack 和 panic 的调用栈不带名字, 那部分在 traceback.go 里, 这里没有改
+func SetGoroutineName(name string) {
+	gid := Getgid()
+	idx := gid % cellSize
+	gpCells[idx].setName(gid, name)
+}
+
+// Getgname 返回 SetGoroutineName 设置的名字, 没设置返回 ""
+func Getgname(gid int64) string {
+	idx := gid % cellSize
+	return gpCells[idx].getName(gid)
+}
+
+// Getgdescendants 返回 gid 最近一次 ResetgPeak 以来创建的, 还活着的后代协程个数, 以及这期间的最大值.
+// 后代里又有 ResetgPeak 过的协程时, 它下面的协程只算在它自己上.
+// 没 ResetgPeak 过的 gid 没有记数, 扫一遍所有协程记录数协程链上有 gid 的活着的协程, peak 和 live 一样
+func Getgdescendants(gid int64) (live, peak int64) {
+	live, peak, tracked := gpCells[gid%cellSize].getDescs(gid)
+	if !tracked {
+		live = countLiveDescendants(gid)
+		peak = live
+	}
+	return
+}
+
+// 拷贝出所有记录的父协程再找, 不同时持多个 cell 的锁
+func countLiveDescendants(gid int64) int64 {
+	parents := map[int64]int64{}
+	var live []int64
+	for i := 0; i < cellSize; i++ {
+		lock(&gpCells[i].lock)
+		for _, v := range gpCells[i].infos {
+			parents[v.gid] = v.pid
+			if v.exitNano == 0 {
+				live = append(live, v.gid)
+			}
+		}
+		unlock(&gpCells[i].lock)
+	}
+	n := int64(0)
+	for _, id := range live {
+		for p, ok := parents[id]; ok && p > 0; p, ok = parents[p] {
+			if p == gid {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// ResetgPeak 开始给 gid 数新的一轮后代协程, 之前创建的后代不再算在 gid 上.
+// 没 ResetgPeak 过的协程不数后代, go 语句和协程退出只多查一次父协程
+func ResetgPeak(gid int64) {
+	gpCells[gid%cellSize].resetPeak(gid)
+}
+
+// SkipgSpawn 当前协程下一个创建的协程和它的后代不算后代, 也不进 CopyGpSpawned,
+// 给 net/http 的 backgroundRead 这种不属于请求的协程用
+func SkipgSpawn() {
+	gid := Getgid()
+	gpCells[gid%cellSize].setSkipNext(gid)
+}
+
+// StartgBlockTrace 开始记 gid 和它之后创建的后代协程的阻塞 (chan, select, 锁, 网络 IO 等 gopark 的地方),
+// 每个协程最多记 maxGBlocks 次, 短于 minGBlockNano 的不记. 要用 StopgBlockTrace 取出来并停掉,
+// 没有协程在记的时候 gopark 只多读一次 gBlockTracing
+func StartgBlockTrace(gid int64) {
+	gpCells[gid%cellSize].startBlocks(gid)
+}
+
+// StopgBlockTrace 返回 gid 记下的阻塞和超过 maxGBlocks 没记的次数, 并停止记录.
+// gid 退出了也能取, 记录清掉了以后取不到
+func StopgBlockTrace(gid int64) (events []GBlockEvent, dropped int) {
+	return gpCells[gid%cellSize].stopBlocks(gid)
+}
+
+// Nanotime 返回 gpCells 里记录时间用的单调时钟
+func Nanotime() int64 {
+	return nanotime()
+}
+
 //
 func onGStartHook(ng, pg *g) {
-	idx := ng.goid % cellSize
-	gpCells[idx].add(ng.goid, pg.goid)
+	tracker, epoch, blocks := gpCells[pg.goid%cellSize].addChild(pg.goid)
+	gpCells[ng.goid%cellSize].add(ng.goid, pg.goid, ng.startpc, tracker, epoch, blocks)
+	if tracker > 0 {
+		gpCells[tracker%cellSize].addSpawned(tracker, ng.goid, epoch)
+	}
 	scanGCellsValid()
 }
 
+// 协程退出时调用, 在 g0 上
+func onGStopHook(gp *g) {
+	tracker, epoch := gpCells[gp.goid%cellSize].exit(gp.goid)
+	if tracker > 0 {
+		gpCells[tracker%cellSize].exitDesc(tracker, epoch)
+	}
+}
+
+// gopark 返回前在协程自己上调用, 阻塞从 start 开始
+func onGBlockHook(gp *g, reason string, start int64) {
+	end := nanotime()
+	if end-start < minGBlockNano {
+		return
+	}
+	gpCells[gp.goid%cellSize].addBlock(gp.goid, reason, start, end)
+}
+
 //
 func Getgid() int64 {
 	_g_ := getg()
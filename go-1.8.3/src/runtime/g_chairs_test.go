@@ -0,0 +1,209 @@
+package runtime_test
+
+import (
+	"runtime"
+	"testing"
+)
+
+// 假协程的 gid, 从很大的数开始, 每个测试用自己的一段
+func fakeGid(base, n int64) int64 {
+	return 1<<40 + base*1000 + n
+}
+
+func TestGpChainKeepsExitedAncestors(t *testing.T) {
+	root, mid, leaf := fakeGid(1, 0), fakeGid(1, 1), fakeGid(1, 2)
+	runtime.GStartHook(root, 1)
+	runtime.GStartHook(mid, root)
+	runtime.GStartHook(leaf, mid)
+
+	// 中间的协程退出很久了, 还活着的 leaf 也要能找到 root
+	runtime.GStopHook(mid)
+	runtime.ClearExitedGp()
+	pgids := make([]int64, 10)
+	if n := runtime.Getgpid(leaf, pgids); n < 3 || pgids[1] != mid || pgids[2] != root {
+		t.Fatalf("chain of %d = %v; want %d, %d, %d, ...", leaf, pgids[:n], leaf, mid, root)
+	}
+
+	// leaf 也退出后, 第一轮清 leaf, 第二轮才清 mid
+	runtime.GStopHook(leaf)
+	runtime.ClearExitedGp()
+	if _, ok := runtime.GetGpInfo(leaf); ok {
+		t.Errorf("exited leaf %d not cleared", leaf)
+	}
+	if _, ok := runtime.GetGpInfo(mid); !ok {
+		t.Errorf("mid %d cleared in the same pass as its child", mid)
+	}
+	runtime.ClearExitedGp()
+	if _, ok := runtime.GetGpInfo(mid); ok {
+		t.Errorf("exited mid %d not cleared after its child", mid)
+	}
+	if _, ok := runtime.GetGpInfo(root); !ok {
+		t.Errorf("running root %d cleared", root)
+	}
+	runtime.GStopHook(root)
+	runtime.ClearExitedGp()
+	if _, ok := runtime.GetGpInfo(root); ok {
+		t.Errorf("exited root %d not cleared", root)
+	}
+}
+
+func TestGoroutineName(t *testing.T) {
+	named, unnamed := fakeGid(2, 0), fakeGid(2, 1)
+	runtime.GStartHook(named, 1)
+	runtime.GStartHook(unnamed, named)
+	defer runtime.GStopHook(unnamed)
+	defer runtime.GStopHook(named)
+	runtime.SetGname(named, "worker")
+
+	if name := runtime.Getgname(named); name != "worker" {
+		t.Errorf("Getgname(%d) = %q; want worker", named, name)
+	}
+	if info, ok := runtime.GetGpInfo(named); !ok || info.Name != "worker" {
+		t.Errorf("GetGpInfo(%d).Name = %q; want worker", named, info.Name)
+	}
+	names := map[int64]string{}
+	runtime.DumpGpCellsNamed(func(gid, pid, nano, val int64, name string) {
+		names[gid] = name
+	})
+	if name, ok := names[named]; !ok || name != "worker" {
+		t.Errorf("DumpGpCellsNamed: %d named %q; want worker", named, name)
+	}
+	if name, ok := names[unnamed]; !ok || name != "" {
+		t.Errorf("DumpGpCellsNamed: %d named %q (found %v); want \"\"", unnamed, name, ok)
+	}
+}
+
+func TestGdescendantsPerEpoch(t *testing.T) {
+	tracker := fakeGid(3, 0)
+	a, b, c, d, e := fakeGid(3, 1), fakeGid(3, 2), fakeGid(3, 3), fakeGid(3, 4), fakeGid(3, 5)
+	runtime.GStartHook(tracker, 1)
+	defer runtime.GStopHook(tracker)
+	check := func(step string, wantLive, wantPeak int64) {
+		if live, peak := runtime.Getgdescendants(tracker); live != wantLive || peak != wantPeak {
+			t.Errorf("%s: Getgdescendants = %d, %d; want %d, %d", step, live, peak, wantLive, wantPeak)
+		}
+	}
+
+	// 第一个请求: a 和 a 创建的 b
+	runtime.ResetgPeak(tracker)
+	runtime.GStartHook(a, tracker)
+	runtime.GStartHook(b, a)
+	check("first request", 2, 2)
+	runtime.GStopHook(a)
+	check("a exited", 1, 2)
+
+	// 第二个请求不算 b, b 退出也不减
+	runtime.ResetgPeak(tracker)
+	check("second request", 0, 0)
+	runtime.GStopHook(b)
+	check("b from first request exited", 0, 0)
+	runtime.GStartHook(c, tracker)
+	check("c started", 1, 1)
+
+	// SkipgSpawn 之后创建的 d 和它的后代 e 都不算
+	runtime.SkipgSpawnFor(tracker)
+	runtime.GStartHook(d, tracker)
+	runtime.GStartHook(e, d)
+	check("skipped d, e", 1, 1)
+	for _, info := range runtime.CopyGpSpawned(tracker) {
+		if info.Gid != c {
+			t.Errorf("CopyGpSpawned has %d; want only %d", info.Gid, c)
+		}
+	}
+	// 只跳过一个
+	runtime.GStopHook(c)
+	runtime.GStartHook(c+100, tracker)
+	check("after skip", 1, 1)
+	for _, g := range []int64{c + 100, d, e} {
+		runtime.GStopHook(g)
+	}
+	check("all exited", 0, 1)
+}
+
+// 没 ResetgPeak 过的协程也能数后代
+func TestGdescendantsUntracked(t *testing.T) {
+	root, child, grandchild := fakeGid(4, 0), fakeGid(4, 1), fakeGid(4, 2)
+	runtime.GStartHook(root, 1)
+	runtime.GStartHook(child, root)
+	runtime.GStartHook(grandchild, child)
+	defer runtime.GStopHook(root)
+
+	if live, peak := runtime.Getgdescendants(root); live != 2 || peak != 2 {
+		t.Errorf("Getgdescendants = %d, %d; want 2, 2", live, peak)
+	}
+	// 中间退出了, 协程链还在
+	runtime.GStopHook(child)
+	if live, _ := runtime.Getgdescendants(root); live != 1 {
+		t.Errorf("after child exited: live = %d; want 1", live)
+	}
+	runtime.GStopHook(grandchild)
+	if live, _ := runtime.Getgdescendants(root); live != 0 {
+		t.Errorf("after grandchild exited: live = %d; want 0", live)
+	}
+}
+
+func TestGBlockTrace(t *testing.T) {
+	root, child, skipped, other := fakeGid(5, 0), fakeGid(5, 1), fakeGid(5, 2), fakeGid(5, 3)
+	runtime.GStartHook(root, 1)
+	runtime.GStartHook(other, 1)
+	defer runtime.GStopHook(root)
+	defer runtime.GStopHook(other)
+
+	tracing := runtime.GBlockTracing()
+	runtime.StartgBlockTrace(root)
+	if n := runtime.GBlockTracing(); n != tracing+1 {
+		t.Fatalf("GBlockTracing = %d after StartgBlockTrace; want %d", n, tracing+1)
+	}
+	runtime.GStartHook(child, root)
+	runtime.SkipgSpawnFor(root)
+	runtime.GStartHook(skipped, root)
+	defer runtime.GStopHook(skipped)
+
+	start := runtime.Nanotime() - 2e6
+	runtime.GBlockHook(root, "chan receive", start)
+	runtime.GBlockHook(root, "select", runtime.Nanotime()) // 太短, 不记
+	runtime.GBlockHook(child, "IO wait", start)
+	runtime.GBlockHook(skipped, "sleep", start)
+	runtime.GBlockHook(other, "sleep", start)
+	// 退出了也能取
+	runtime.GStopHook(child)
+
+	events, dropped := runtime.StopgBlockTrace(root)
+	if len(events) != 1 || dropped != 0 {
+		t.Fatalf("root blocks = %+v, dropped %d; want one chan receive", events, dropped)
+	}
+	if ev := events[0]; ev.Reason != "chan receive" || ev.Start != start || ev.End-ev.Start < 2e6 {
+		t.Errorf("root block = %+v; want chan receive from %d, >= 2ms", ev, start)
+	}
+	if events, _ := runtime.StopgBlockTrace(child); len(events) != 1 || events[0].Reason != "IO wait" {
+		t.Errorf("child blocks = %+v; want one IO wait", events)
+	}
+	for _, gid := range []int64{skipped, other} {
+		if events, _ := runtime.StopgBlockTrace(gid); len(events) != 0 {
+			t.Errorf("goroutine %d blocks = %+v; want none", gid, events)
+		}
+	}
+	if n := runtime.GBlockTracing(); n != tracing {
+		t.Errorf("GBlockTracing = %d after StopgBlockTrace; want %d", n, tracing)
+	}
+
+	// 停了以后不再记
+	runtime.GBlockHook(root, "chan receive", start)
+	if events, _ := runtime.StopgBlockTrace(root); len(events) != 0 {
+		t.Errorf("blocks recorded after StopgBlockTrace: %+v", events)
+	}
+}
+
+func TestGBlockTraceDropped(t *testing.T) {
+	gid := fakeGid(6, 0)
+	runtime.GStartHook(gid, 1)
+	defer runtime.GStopHook(gid)
+	runtime.StartgBlockTrace(gid)
+	start := runtime.Nanotime() - 1e6
+	for i := 0; i < 70; i++ {
+		runtime.GBlockHook(gid, "select", start)
+	}
+	if events, dropped := runtime.StopgBlockTrace(gid); len(events) != 64 || dropped != 6 {
+		t.Errorf("got %d blocks, %d dropped; want 64, 6", len(events), dropped)
+	}
+}
@@ -0,0 +1,38 @@
+package runtime
+
+// lbh trace net/http 的 span 写进 execution trace (runtime/trace.Start),
+// 事件号接在 traceEvCount 后面, internal/trace 里的 EvSpanServer.. 要和这里一致
+const (
+	traceEvSpanServer = traceEvCount + iota // server span 开始 [timestamp, trace id 高 64 位, trace id 低 64 位, span id]
+	traceEvSpanClient                       // client span 开始 [timestamp, trace id 高 64 位, trace id 低 64 位, span id]
+	traceEvSpanLocal                        // 本地 span 开始 (http.StartSpan) [timestamp, trace id 高 64 位, trace id 低 64 位, span id]
+	traceEvSpanEnd                          // span 结束 [timestamp, span id]
+)
+
+// TraceSpanStart 的 kind
+const (
+	TraceSpanServer = iota
+	TraceSpanClient
+	TraceSpanLocal
+)
+
+// TraceEnabled 返回 execution trace 是否打开, 没打开时不用准备 TraceSpanStart 的参数
+func TraceEnabled() bool {
+	return trace.enabled
+}
+
+// TraceSpanStart 在当前协程上记一个 span 开始的事件, 64 位的 trace id traceIdHigh 为 0
+func TraceSpanStart(kind int, traceIdHigh, traceIdLow, spanId uint64) {
+	if !trace.enabled || kind < TraceSpanServer || kind > TraceSpanLocal {
+		return
+	}
+	traceEvent(traceEvSpanServer+byte(kind), -1, traceIdHigh, traceIdLow, spanId)
+}
+
+// TraceSpanEnd 记 span 结束的事件, 可以和开始不在一个协程
+func TraceSpanEnd(spanId uint64) {
+	if !trace.enabled {
+		return
+	}
+	traceEvent(traceEvSpanEnd, -1, spanId)
+}
@@ -267,8 +267,17 @@ func gopark(unlockf func(*g, unsafe.Pointer) bool, lock unsafe.Pointer, reason s
 	mp.waittraceev = traceEv
 	mp.waittraceskip = traceskip
 	releasem(mp)
+	// lbh trace 有协程在记阻塞时记下开始时间
+	blockStart := int64(0)
+	if gBlockTracing > 0 {
+		blockStart = nanotime()
+	}
 	// can't do anything that might move the G between Ms here.
 	mcall(park_m)
+	// lbh trace 被唤醒重新运行了, 记下这次阻塞
+	if blockStart != 0 {
+		onGBlockHook(gp, reason, blockStart)
+	}
 }
 
 // Puts the current goroutine into a waiting state and unlocks the lock.
@@ -2339,6 +2348,8 @@ func goexit0(gp *g) {
 	if isSystemGoroutine(gp) {
 		atomic.Xadd(&sched.ngsys, -1)
 	}
+	// lbh trace 协程退出的hook
+	onGStopHook(gp)
 	gp.m = nil
 	gp.lockedm = nil
 	_g_.m.lockedg = nil